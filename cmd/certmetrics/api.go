@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// apiDefaultLimit and apiMaxLimit bound how many certs are returned per page
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiCert is a cert as returned by the JSON API. Key is the same as in /cert/{key} links.
+type apiCert struct {
+	Key               string     `json:"key"`
+	CertURL           string     `json:"cert_url"`
+	Domains           []string   `json:"domains"`
+	IssuerCN          string     `json:"issuer_cn"`
+	IssuerO           string     `json:"issuer_o"`
+	NotValidBefore    *time.Time `json:"not_valid_before"`
+	NotValidAfter     *time.Time `json:"not_valid_after"`
+	Discovered        time.Time  `json:"discovered"`
+	Jurisdiction      string     `json:"jurisdiction"`
+	CDN               string     `json:"cdn"`
+	EntryType         string     `json:"entry_type"`
+	KeyType           string     `json:"key_type"`
+	FingerprintSHA256 string     `json:"fingerprint_sha256"`
+	FingerprintSHA1   string     `json:"fingerprint_sha1"`
+	Logs              []string   `json:"logs"`
+}
+
+type apiCertsResponse struct {
+	Certs []*apiCert `json:"certs"`
+
+	// NextCursor is passed as cursor to get the next page, and is empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// apiCursor is the position after the last cert on a page. Certs are ordered newest discovered first.
+type apiCursor struct {
+	Discovered time.Time `json:"d"`
+	Key        []byte    `json:"k"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// certQuery builds the WHERE clause for a cert search, numbering the placeholders as it goes
+type certQuery struct {
+	where []string
+	args  []interface{}
+}
+
+func (cq *certQuery) add(clause string, args ...interface{}) {
+	for _, a := range args {
+		cq.args = append(cq.args, a)
+		clause = strings.Replace(clause, "?", "$"+strconv.Itoa(len(cq.args)), 1)
+	}
+	cq.where = append(cq.where, clause)
+}
+
+// parseTimeParam parses an RFC 3339 time or date from the named form value, if set
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, v)
+		if err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("bad %s, want RFC 3339 time or YYYY-MM-DD date: %s", name, v)
+}
+
+// apiDomainCerts lists certs for a domain and its subdomains, with the same filters as apiCerts
+func (s *server) apiDomainCerts(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(strings.TrimSpace(mux.Vars(r)["domain"]))
+	if domain == "" {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: "missing domain"})
+		return
+	}
+	cq := &certQuery{}
+	cq.add("s.key IN ("+domainKeys("?", "?")+")", domain, subdomainPattern(domain))
+	s.findCerts(w, r, cq)
+}
+
+// apiCerts lists certs, newest discovered first. Filters are: issuer (CN or O), jurisdiction, cdn,
+// valid_from and valid_to (certs valid at any time between them), discovered_from and discovered_to,
+// and active=true (valid now). limit sets the page size, and cursor is next_cursor from the previous page.
+func (s *server) apiCerts(w http.ResponseWriter, r *http.Request) {
+	s.findCerts(w, r, &certQuery{})
+}
+
+func (s *server) findCerts(w http.ResponseWriter, r *http.Request, cq *certQuery) {
+	if v := r.FormValue("issuer"); v != "" {
+		cq.add("(lower(s.issuer_cn) = lower(?) OR lower(s.issuer_o) = lower(?))", v, v)
+	}
+	if v := r.FormValue("jurisdiction"); v != "" {
+		cq.add("s.jurisdiction = ?", v)
+	}
+	if v := r.FormValue("cdn"); v != "" {
+		cq.add("s.cdn = ?", v)
+	}
+
+	for _, p := range []struct {
+		param, clause string
+	}{
+		{"valid_from", "s.not_valid_after >= ?"},
+		{"valid_to", "s.not_valid_before <= ?"},
+		{"discovered_from", "s.discovered >= ?"},
+		{"discovered_to", "s.discovered < ?"},
+	} {
+		t, err := parseTimeParam(r, p.param)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+			return
+		}
+		if t != nil {
+			cq.add(p.clause, *t)
+		}
+	}
+
+	switch r.FormValue("active") {
+	case "", "false":
+	case "true":
+		cq.add("now() BETWEEN s.not_valid_before AND s.not_valid_after")
+	default:
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: "bad active, want true or false"})
+		return
+	}
+
+	limit := apiDefaultLimit
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: fmt.Sprintf("bad limit, want 1 to %d", apiMaxLimit)})
+			return
+		}
+	}
+
+	if v := r.FormValue("cursor"); v != "" {
+		var cursor apiCursor
+		bb, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(bb, &cursor)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &apiError{Error: "bad cursor"})
+			return
+		}
+		cq.add("(s.discovered, s.key) < (?, ?)", cursor.Discovered, cursor.Key)
+	}
+
+	where := "TRUE"
+	if len(cq.where) != 0 {
+		where = strings.Join(cq.where, " AND ")
+	}
+	// Fetch one more than we need, to know if there is another page
+	cq.args = append(cq.args, limit+1)
+	rows, err := s.DB.Query(`
+		SELECT s.key, ARRAY(SELECT i.domain FROM cert_index i WHERE i.key = s.key ORDER BY i.domain),
+			COALESCE(s.issuer_cn, ''), COALESCE(s.issuer_o, ''), s.not_valid_before, s.not_valid_after, s.discovered,
+			COALESCE(s.jurisdiction, ''), COALESCE(s.cdn, ''), COALESCE(s.entry_type, ''), COALESCE(s.key_type, ''),
+			COALESCE(s.fingerprint_sha256, ''), COALESCE(s.fingerprint_sha1, ''),
+			ARRAY(SELECT l.log_url FROM cert_logs l WHERE l.key = s.key ORDER BY l.first_seen)
+		FROM cert_store s
+		WHERE `+where+`
+		ORDER BY s.discovered DESC, s.key DESC
+		LIMIT $`+strconv.Itoa(len(cq.args)), cq.args...)
+	if err != nil {
+		log.Println(err)
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad query"})
+		return
+	}
+	defer rows.Close()
+
+	rv := &apiCertsResponse{Certs: []*apiCert{}}
+	var lastKey []byte
+	for rows.Next() {
+		var c apiCert
+		var key []byte
+		err = rows.Scan(&key, &c.Domains, &c.IssuerCN, &c.IssuerO, &c.NotValidBefore, &c.NotValidAfter, &c.Discovered,
+			&c.Jurisdiction, &c.CDN, &c.EntryType, &c.KeyType, &c.FingerprintSHA256, &c.FingerprintSHA1, &c.Logs)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad data"})
+			return
+		}
+		if len(rv.Certs) == limit {
+			bb, err := json.Marshal(&apiCursor{Discovered: rv.Certs[limit-1].Discovered, Key: lastKey})
+			if err != nil {
+				log.Println(err)
+				writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad cursor"})
+				return
+			}
+			rv.NextCursor = base64.RawURLEncoding.EncodeToString(bb)
+			break
+		}
+		c.Key = base64.RawURLEncoding.EncodeToString(key)
+		c.CertURL = "/cert/" + c.Key
+		rv.Certs = append(rv.Certs, &c)
+		lastKey = key
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad data"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rv)
+}
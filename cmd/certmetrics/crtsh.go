@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+)
+
+const (
+	// crtshMaxResults limits how many certs are returned for one query
+	crtshMaxResults = 10000
+
+	// crt.sh formats times without a zone, in UTC
+	crtshTimeFormat      = "2006-01-02T15:04:05"
+	crtshEntryTimeFormat = "2006-01-02T15:04:05.999"
+)
+
+// crtshEntry is a result in the same format as crt.sh's output=json. id and issuer_ca_id are stable
+// numbers of our own, not crt.sh's, as we don't have those. entry_timestamp is when we first saw the cert
+// in a log, as the log's timestamp isn't stored.
+type crtshEntry struct {
+	IssuerCAID     uint32 `json:"issuer_ca_id"`
+	IssuerName     string `json:"issuer_name"`
+	CommonName     string `json:"common_name"`
+	NameValue      string `json:"name_value"`
+	ID             int64  `json:"id"`
+	EntryTimestamp string `json:"entry_timestamp"`
+	NotBefore      string `json:"not_before"`
+	NotAfter       string `json:"not_after"`
+	SerialNumber   string `json:"serial_number"`
+	ResultCount    int    `json:"result_count"`
+}
+
+// parseLeaf returns the certificate (or precertificate) in a cert_store leaf
+func parseLeaf(data []byte) (*ct.MerkleTreeLeaf, *ctx509.Certificate, error) {
+	var leaf ct.MerkleTreeLeaf
+	_, err := cttls.Unmarshal(data, &leaf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *ctx509.Certificate
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		cert, _ = leaf.X509Certificate()
+	case ct.PrecertLogEntryType:
+		cert, _ = leaf.Precertificate()
+	}
+	if cert == nil {
+		return nil, nil, errors.New("unknown entry type")
+	}
+	return &leaf, cert, nil
+}
+
+// crtshName formats a name the way crt.sh does, e.g. C=US, O=Let's Encrypt, CN=R3
+func crtshName(n pkix.Name) string {
+	var parts []string
+	add := func(attr string, vals []string) {
+		for _, v := range vals {
+			parts = append(parts, attr+"="+v)
+		}
+	}
+	add("C", n.Country)
+	add("ST", n.Province)
+	add("L", n.Locality)
+	add("O", n.Organization)
+	add("OU", n.OrganizationalUnit)
+	if n.CommonName != "" {
+		add("CN", []string{n.CommonName})
+	}
+	return strings.Join(parts, ", ")
+}
+
+// crtshSerial is the serial number as lower case hex, padded to whole bytes like crt.sh
+func crtshSerial(cert *ctx509.Certificate) string {
+	if cert.SerialNumber == nil {
+		return ""
+	}
+	rv := cert.SerialNumber.Text(16)
+	if len(rv)%2 != 0 {
+		rv = "0" + rv
+	}
+	return rv
+}
+
+// crtshCondition converts a crt.sh query, where % is a wildcard, to a condition on the domain column of
+// cert_index and its argument. Only the forms that can use an index are supported: an exact name, a leading
+// wildcard such as %.example.gov.au, matched by a prefix of reverse(domain), or a trailing one such as
+// www.example.%.
+func crtshCondition(q string) (string, string, error) {
+	q = strings.ToLower(strings.TrimSpace(q))
+	switch n := strings.Count(q, "%"); {
+	case n == 0:
+		return "domain = $1", q, nil
+	case n == 1 && strings.HasPrefix(q, "%") && len(q) > 1:
+		return "reverse(domain) LIKE $1", likeEscape(reverseString(q[1:])) + "%", nil
+	case n == 1 && strings.HasSuffix(q, "%") && len(q) > 1:
+		return "domain LIKE $1", likeEscape(q[:len(q)-1]) + "%", nil
+	default:
+		return "", "", fmt.Errorf("unsupported query %s, want a name, %%.example.gov.au or www.example.%%", q)
+	}
+}
+
+// crtsh answers queries in the same form as crt.sh, e.g. /?q=%.example.gov.au&output=json, so that
+// existing tools can use it. Matching names are found in cert_index, so only watched domains are searched.
+// exclude=expired and deduplicate=Y are supported, the latter dropping precertificates where we have
+// the final certificate.
+func (s *server) crtsh(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	if q == "" {
+		q = r.FormValue("identity")
+	}
+	if q == "" {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: "missing q"})
+		return
+	}
+	cond, arg, err := crtshCondition(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &apiError{Error: err.Error()})
+		return
+	}
+	excludeExpired := r.FormValue("exclude") == "expired"
+	deduplicate := strings.EqualFold(r.FormValue("deduplicate"), "Y")
+
+	rows, err := s.DB.Query(`
+		SELECT s.key, s.leaf,
+			ARRAY(SELECT domain FROM cert_index i WHERE i.key = s.key AND (`+cond+`) ORDER BY domain),
+			COALESCE((SELECT MIN(l.first_seen) FROM cert_logs l WHERE l.key = s.key), s.discovered)
+		FROM cert_store s
+		WHERE s.key IN (SELECT key FROM cert_index WHERE `+cond+`)
+		AND ($2 = FALSE OR s.not_valid_after > now())
+		ORDER BY s.discovered DESC
+		LIMIT $3`, arg, excludeExpired, crtshMaxResults)
+	if err != nil {
+		log.Println(err)
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad query"})
+		return
+	}
+	defer rows.Close()
+
+	rv := []*crtshEntry{}
+	var precerts []*crtshEntry
+	finals := make(map[string]bool)
+	for rows.Next() {
+		var key, data []byte
+		var names []string
+		var entryTimestamp time.Time
+		err = rows.Scan(&key, &data, &names, &entryTimestamp)
+		if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad data"})
+			return
+		}
+		leaf, cert, err := parseLeaf(data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		issuer := crtshName(cert.Issuer)
+		h := fnv.New32a()
+		h.Write([]byte(issuer))
+		e := &crtshEntry{
+			IssuerCAID:     h.Sum32(),
+			IssuerName:     issuer,
+			CommonName:     cert.Subject.CommonName,
+			NameValue:      strings.Join(names, "\n"),
+			ID:             int64(binary.BigEndian.Uint64(key[:8]) >> 1),
+			EntryTimestamp: entryTimestamp.UTC().Format(crtshEntryTimeFormat),
+			NotBefore:      cert.NotBefore.UTC().Format(crtshTimeFormat),
+			NotAfter:       cert.NotAfter.UTC().Format(crtshTimeFormat),
+			SerialNumber:   crtshSerial(cert),
+			ResultCount:    len(names),
+		}
+
+		if deduplicate {
+			id := issuer + "|" + e.SerialNumber
+			if leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+				precerts = append(precerts, e)
+				continue
+			}
+			finals[id] = true
+		}
+		rv = append(rv, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Println(err)
+		writeJSON(w, http.StatusInternalServerError, &apiError{Error: "bad data"})
+		return
+	}
+
+	for _, e := range precerts {
+		if !finals[e.IssuerName+"|"+e.SerialNumber] {
+			rv = append(rv, e)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, rv)
+}
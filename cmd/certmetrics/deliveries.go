@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/govau/certwatch/jobs"
+)
+
+const (
+	maxDeliveryResults = 100
+)
+
+// requireAdmin only allows requests with the admin token, either as a bearer token, or as the
+// password for basic auth so that a browser can be used
+func (s *server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="certmetrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// listDeliveries shows the most recent notification deliveries, optionally for one channel
+// (by name) and status
+func (s *server) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	status := r.FormValue("status")
+
+	rows, err := s.DB.Query(`
+		SELECT d.id, c.name, d.event_type, d.key, d.status, d.attempts, d.response_code, COALESCE(d.last_error, ''), d.created, d.updated
+		FROM notification_deliveries d
+		JOIN notification_channels c ON c.id = d.channel_id
+		WHERE ($1 = '' OR c.name = $1) AND ($2 = '' OR d.status = $2)
+		ORDER BY d.id DESC
+		LIMIT $3`, channel, status, maxDeliveryResults)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/plain")
+	for rows.Next() {
+		var id int64
+		var channelName, eventType, deliveryStatus, lastError string
+		var key []byte
+		var attempts int32
+		var responseCode *int32
+		var created, updated time.Time
+		err = rows.Scan(&id, &channelName, &eventType, &key, &deliveryStatus, &attempts, &responseCode, &lastError, &created, &updated)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		fmt.Fprintf(w, "/admin/deliveries/%d\n", id)
+		fmt.Fprintf(w, "  channel:  %s\n", channelName)
+		fmt.Fprintf(w, "  event:    %s\n", eventType)
+		if key != nil {
+			fmt.Fprintf(w, "  cert:     /cert/%s\n", base64.RawURLEncoding.EncodeToString(key))
+		}
+		fmt.Fprintf(w, "  status:   %s after %d attempts (created %s, updated %s)\n", deliveryStatus, attempts, created.Format(time.RFC3339), updated.Format(time.RFC3339))
+		if responseCode != nil {
+			fmt.Fprintf(w, "  response: %d\n", *responseCode)
+		}
+		if lastError != "" {
+			fmt.Fprintf(w, "  error:    %s\n", lastError)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// showDelivery shows the payload of a delivery
+func (s *server) showDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Bad id", http.StatusBadRequest)
+		return
+	}
+
+	var payload []byte
+	err = s.DB.QueryRow("SELECT jsonb_pretty(payload) FROM notification_deliveries WHERE id = $1", id).Scan(&payload)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// replayDeliveries resets the matching deliveries to pending, clearing the outcome of the last run, and
+// queues them to be sent again
+func (s *server) replayDeliveries(w http.ResponseWriter, where string, arg interface{}) {
+	ct, err := s.DB.Exec(`
+		WITH d AS (
+			UPDATE notification_deliveries SET status = $2, attempts = 0, response_code = NULL, last_error = NULL, updated = now()
+			WHERE `+where+`
+			RETURNING id, channel_id, payload
+		)
+		INSERT INTO que_jobs (job_class, args)
+		SELECT $1::text, json_build_object('ChannelID', d.channel_id, 'DeliveryID', d.id, 'Event', d.payload) FROM d`, jobs.KeyNotify, jobs.DeliveryPending, arg)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Error replaying", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Replaying %d deliveries\n", ct.RowsAffected())
+}
+
+// replayDelivery sends a single delivery again. Only deliveries that are finished with can be replayed, as
+// pending and retrying ones still have a job queued, which would send it twice.
+func (s *server) replayDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Bad id", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	err = s.DB.QueryRow("SELECT status FROM notification_deliveries WHERE id = $1", id).Scan(&status)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	switch status {
+	case jobs.DeliveryFailed, jobs.DeliverySent, jobs.DeliveryDropped:
+	default:
+		http.Error(w, fmt.Sprintf("Delivery is %s, only %s, %s or %s deliveries can be replayed", status, jobs.DeliveryFailed, jobs.DeliverySent, jobs.DeliveryDropped), http.StatusConflict)
+		return
+	}
+
+	// Checked again, in case it changed since
+	s.replayDeliveries(w, fmt.Sprintf("id = $3 AND status IN ('%s', '%s', '%s')", jobs.DeliveryFailed, jobs.DeliverySent, jobs.DeliveryDropped), id)
+}
+
+// replayFailedDeliveries sends all failed deliveries for a channel (by name) again
+func (s *server) replayFailedDeliveries(w http.ResponseWriter, r *http.Request) {
+	s.replayDeliveries(w, fmt.Sprintf("status = '%s' AND channel_id = (SELECT id FROM notification_channels WHERE name = $3)", jobs.DeliveryFailed), mux.Vars(r)["name"])
+}
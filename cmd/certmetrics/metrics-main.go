@@ -6,18 +6,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/govau/cf-common/jobs"
+	commonjobs "github.com/govau/cf-common/jobs"
 	"github.com/jackc/pgx"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	ct "github.com/google/certificate-transparency-go"
-	cttls "github.com/google/certificate-transparency-go/tls"
-	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/google/certificate-transparency-go/x509util"
 )
 
@@ -58,6 +57,38 @@ var (
 		Name: "active_certs_by_issuer",
 		Help: "active certs by issuer (not expired)",
 	}, []string{"jurisdiction", "issuer"})
+	notificationsSuppressed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "notifications_suppressed",
+		Help: "notifications suppressed by each suppression rule",
+	}, []string{"rule", "description", "active"})
+	ckanOutbox = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckan_outbox",
+		Help: "certs waiting to be sent to CKAN, or that CKAN has rejected",
+	}, []string{"failed"})
+	openSearchOutbox = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "opensearch_outbox",
+		Help: "certs waiting to be indexed in OpenSearch, or that OpenSearch has rejected",
+	}, []string{"failed"})
+	streamOutbox = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stream_outbox",
+		Help: "events waiting to be published to the stream, or given up on after too many attempts",
+	}, []string{"failed"})
+	ckanReconcile = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckan_reconcile_records",
+		Help: "records found by the last CKAN reconciliation: in ckan, local, missing from ckan, extra in ckan, or failed (missing and given up on by the outbox)",
+	}, []string{"count"})
+	ckanReconcileFinished = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ckan_reconcile_finished_timestamp_seconds",
+		Help: "when the last CKAN reconciliation finished",
+	})
+	metadataRefreshRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "metadata_refresh_remaining",
+		Help: "certs waiting for their metadata to be refreshed",
+	})
+	metadataRefreshRanges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "metadata_refresh_ranges",
+		Help: "key ranges with a metadata refresh outstanding",
+	})
 )
 
 func init() {
@@ -71,10 +102,28 @@ func init() {
 	prometheus.MustRegister(activeLogsMonitored)
 	prometheus.MustRegister(activeCertsByCDN)
 	prometheus.MustRegister(activeCertsByIssuer)
+	prometheus.MustRegister(notificationsSuppressed)
+	prometheus.MustRegister(ckanOutbox)
+	prometheus.MustRegister(openSearchOutbox)
+	prometheus.MustRegister(streamOutbox)
+	prometheus.MustRegister(ckanReconcile)
+	prometheus.MustRegister(ckanReconcileFinished)
+	prometheus.MustRegister(metadataRefreshRemaining)
+	prometheus.MustRegister(metadataRefreshRanges)
 }
 
+const (
+	maxSearchResults = 100
+)
+
 type server struct {
 	DB *pgx.ConnPool
+
+	// SlackSigningSecret verifies requests to /slack/actions, which is only served if set
+	SlackSigningSecret string
+
+	// AdminToken is required for /admin, which is only served if set
+	AdminToken string
 }
 
 func (s *server) updateStatLoop() {
@@ -116,7 +165,97 @@ func (s *server) updateStatLoop() {
 			activeLogsMonitored.Set(float64(i))
 		}
 
-		rows, err := s.DB.Query(`SELECT l.processed, l.url FROM monitored_logs l`)
+		err = s.DB.QueryRow("SELECT COUNT(*) FROM cert_store WHERE needs_update = TRUE").Scan(&i)
+		if err != nil {
+			log.Println(err)
+		} else {
+			metadataRefreshRemaining.Set(float64(i))
+		}
+
+		err = s.DB.QueryRow("SELECT COUNT(*) FROM que_jobs WHERE job_class = 'update_metadata_range'").Scan(&i)
+		if err != nil {
+			log.Println(err)
+		} else {
+			metadataRefreshRanges.Set(float64(i))
+		}
+
+		rows, err := s.DB.Query(`SELECT failed, COUNT(*) FROM ckan_outbox GROUP BY failed`)
+		if err != nil {
+			log.Println(err)
+		} else {
+			ckanOutbox.Reset()
+			ckanOutbox.With(prometheus.Labels{"failed": "false"}).Set(0.0)
+			ckanOutbox.With(prometheus.Labels{"failed": "true"}).Set(0.0)
+			for rows.Next() {
+				var failed bool
+				var count int64
+				err = rows.Scan(&failed, &count)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+				ckanOutbox.With(prometheus.Labels{"failed": strconv.FormatBool(failed)}).Set(float64(count))
+			}
+			rows.Close()
+		}
+
+		rows, err = s.DB.Query(`SELECT failed, COUNT(*) FROM opensearch_outbox GROUP BY failed`)
+		if err != nil {
+			log.Println(err)
+		} else {
+			openSearchOutbox.Reset()
+			openSearchOutbox.With(prometheus.Labels{"failed": "false"}).Set(0.0)
+			openSearchOutbox.With(prometheus.Labels{"failed": "true"}).Set(0.0)
+			for rows.Next() {
+				var failed bool
+				var count int64
+				err = rows.Scan(&failed, &count)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+				openSearchOutbox.With(prometheus.Labels{"failed": strconv.FormatBool(failed)}).Set(float64(count))
+			}
+			rows.Close()
+		}
+
+		rows, err = s.DB.Query(`SELECT failed, COUNT(*) FROM stream_outbox GROUP BY failed`)
+		if err != nil {
+			log.Println(err)
+		} else {
+			streamOutbox.Reset()
+			streamOutbox.With(prometheus.Labels{"failed": "false"}).Set(0.0)
+			streamOutbox.With(prometheus.Labels{"failed": "true"}).Set(0.0)
+			for rows.Next() {
+				var failed bool
+				var count int64
+				err = rows.Scan(&failed, &count)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+				streamOutbox.With(prometheus.Labels{"failed": strconv.FormatBool(failed)}).Set(float64(count))
+			}
+			rows.Close()
+		}
+
+		var fetched, local, missing, extra, failed int64
+		var finished time.Time
+		err = s.DB.QueryRow("SELECT fetched, local, missing, extra, COALESCE(failed, 0), finished FROM ckan_reconcile_runs WHERE finished IS NOT NULL ORDER BY finished DESC LIMIT 1").Scan(&fetched, &local, &missing, &extra, &failed, &finished)
+		if err != nil {
+			if err != pgx.ErrNoRows {
+				log.Println(err)
+			}
+		} else {
+			ckanReconcile.With(prometheus.Labels{"count": "ckan"}).Set(float64(fetched))
+			ckanReconcile.With(prometheus.Labels{"count": "local"}).Set(float64(local))
+			ckanReconcile.With(prometheus.Labels{"count": "missing"}).Set(float64(missing))
+			ckanReconcile.With(prometheus.Labels{"count": "extra"}).Set(float64(extra))
+			ckanReconcile.With(prometheus.Labels{"count": "failed"}).Set(float64(failed))
+			ckanReconcileFinished.Set(float64(finished.Unix()))
+		}
+
+		rows, err = s.DB.Query(`SELECT l.processed, l.url FROM monitored_logs l`)
 		if err != nil {
 			log.Println(err)
 		} else {
@@ -194,6 +333,25 @@ func (s *server) updateStatLoop() {
 			rows.Close()
 		}
 
+		rows, err = s.DB.Query(`SELECT r.id, r.description, r.expires IS NULL OR r.expires > now(), (SELECT COUNT(*) FROM notification_suppression_hits h WHERE h.suppression_id = r.id) FROM notification_suppressions r`)
+		if err != nil {
+			log.Println(err)
+		} else {
+			notificationsSuppressed.Reset()
+			for rows.Next() {
+				var id, count int64
+				var description string
+				var active bool
+				err = rows.Scan(&id, &description, &active, &count)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+				notificationsSuppressed.With(prometheus.Labels{"rule": strconv.FormatInt(id, 10), "description": description, "active": strconv.FormatBool(active)}).Set(float64(count))
+			}
+			rows.Close()
+		}
+
 		time.Sleep(time.Second * 30)
 	}
 }
@@ -212,32 +370,117 @@ func (s *server) showCert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var leaf ct.MerkleTreeLeaf
-	_, err = cttls.Unmarshal(data, &leaf)
+	_, cert, err := parseLeaf(data)
 	if err != nil {
 		http.Error(w, "Bad data", http.StatusInternalServerError)
 		return
 	}
 
-	var cert *ctx509.Certificate
-	switch leaf.TimestampedEntry.EntryType {
-	case ct.X509LogEntryType:
-		cert, _ = leaf.X509Certificate()
-	case ct.PrecertLogEntryType:
-		cert, _ = leaf.Precertificate()
-	default:
-		http.Error(w, "Bad data - 1", http.StatusInternalServerError)
+	rows, err := s.DB.Query("SELECT name_type, name, matched FROM cert_names WHERE key = $1 ORDER BY matched DESC, name_type, name", key)
+	if err != nil {
+		http.Error(w, "Bad data - 2", http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
 	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Names on this certificate (* = co-hosted, not a watched domain):\n")
+	for rows.Next() {
+		var nameType, name string
+		var matched bool
+		err = rows.Scan(&nameType, &name, &matched)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		marker := " "
+		if !matched {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s %-5s %s\n", marker, nameType, name)
+	}
+	rows.Close()
+
+	rows, err = s.DB.Query("SELECT response, user_name, user_id, channel, created FROM cert_triage WHERE key = $1 ORDER BY created", key)
+	if err != nil {
+		log.Println(err)
+	} else {
+		gotOne := false
+		for rows.Next() {
+			var response, userName, userID, channel string
+			var created time.Time
+			err = rows.Scan(&response, &userName, &userID, &channel, &created)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if !gotOne {
+				fmt.Fprintf(w, "\nTriage:\n")
+				gotOne = true
+			}
+			fmt.Fprintf(w, "  %s %s by %s (%s) in #%s\n", created.Format(time.RFC3339), response, userName, userID, channel)
+		}
+		rows.Close()
+	}
+
+	fmt.Fprintf(w, "\n")
 	w.Write([]byte(x509util.CertificateToString(cert)))
 }
 
+// searchCerts lists certs for a domain and its subdomains, along with any co-hosted names that
+// are not watched domains. If cohosted=true is passed, only certs with co-hosted names are shown.
+func (s *server) searchCerts(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if q == "" {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+	cohostedOnly := r.FormValue("cohosted") == "true"
+
+	rows, err := s.DB.Query(`
+		SELECT s.key, COALESCE(s.issuer_cn, ''), s.not_valid_before, s.not_valid_after,
+			ARRAY(SELECT n.name FROM cert_names n WHERE n.key = s.key AND n.matched ORDER BY n.name) AS matched,
+			ARRAY(SELECT n.name FROM cert_names n WHERE n.key = s.key AND NOT n.matched ORDER BY n.name) AS cohosted
+		FROM cert_store s
+		WHERE s.key IN (SELECT key FROM cert_names WHERE name = $1 OR reverse(name) LIKE $2)
+		AND ($3 = FALSE OR EXISTS (SELECT 1 FROM cert_names n WHERE n.key = s.key AND NOT n.matched))
+		ORDER BY s.not_valid_before DESC
+		LIMIT $4`, q, subdomainPattern(q), cohostedOnly, maxSearchResults)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/plain")
+	for rows.Next() {
+		var key []byte
+		var issuer string
+		var nvb, nva time.Time
+		var matched, cohosted []string
+		err = rows.Scan(&key, &issuer, &nvb, &nva, &matched, &cohosted)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		fmt.Fprintf(w, "/cert/%s\n", base64.RawURLEncoding.EncodeToString(key))
+		fmt.Fprintf(w, "  issuer:   %s\n", issuer)
+		fmt.Fprintf(w, "  validity: %s - %s\n", nvb.Format(time.RFC3339), nva.Format(time.RFC3339))
+		for _, n := range matched {
+			fmt.Fprintf(w, "    %s\n", n)
+		}
+		for _, n := range cohosted {
+			fmt.Fprintf(w, "  * %s\n", n)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
 func main() {
 	pgxPool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
 		MaxConnections: 2,
-		ConnConfig:     *jobs.MustPGXConfigFromCloudFoundry(),
+		ConnConfig:     *commonjobs.MustPGXConfigFromCloudFoundry(),
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -245,7 +488,9 @@ func main() {
 	defer pgxPool.Close()
 
 	s := &server{
-		DB: pgxPool,
+		DB:                 pgxPool,
+		SlackSigningSecret: os.Getenv("SLACK_SIGNING_SECRET"),
+		AdminToken:         os.Getenv("ADMIN_TOKEN"),
 	}
 
 	go s.updateStatLoop()
@@ -254,7 +499,26 @@ func main() {
 
 	r := mux.NewRouter()
 	r.Handle("/metrics", promhttp.Handler())
-	r.HandleFunc("/cert/{key}", s.showCert)
+	r.HandleFunc("/cert/{key}", s.webCertPage)
+	r.HandleFunc("/search", s.searchCerts)
+	r.HandleFunc("/", s.crtsh).Queries("output", "json")
+	r.HandleFunc("/crtsh", s.crtsh)
+	r.HandleFunc("/", s.webHome)
+	r.HandleFunc("/domain/{domain}", s.webDomain)
+	r.HandleFunc("/issuers", s.webIssuers)
+	r.HandleFunc("/issuer", s.webIssuer)
+	r.PathPrefix("/static/").Handler(staticHandler())
+	r.HandleFunc("/api/v1/certs", s.apiCerts).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/domains/{domain}/certs", s.apiDomainCerts).Methods(http.MethodGet)
+	if s.SlackSigningSecret != "" {
+		r.HandleFunc("/slack/actions", s.slackActions).Methods(http.MethodPost)
+	}
+	if s.AdminToken != "" {
+		r.HandleFunc("/admin/deliveries", s.requireAdmin(s.listDeliveries))
+		r.HandleFunc("/admin/deliveries/{id}", s.requireAdmin(s.showDelivery))
+		r.HandleFunc("/admin/deliveries/{id}/replay", s.requireAdmin(s.replayDelivery)).Methods(http.MethodPost)
+		r.HandleFunc("/admin/channels/{name}/replay-failed", s.requireAdmin(s.replayFailedDeliveries)).Methods(http.MethodPost)
+	}
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), r))
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+)
+
+// likeEscape escapes s for use in a LIKE pattern, so that it only matches itself
+func likeEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	s = strings.Replace(s, "_", `\_`, -1)
+	return s
+}
+
+// reverseString reverses s by character, the same as PostgreSQL's reverse()
+func reverseString(s string) string {
+	rs := []rune(s)
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+	return string(rs)
+}
+
+// subdomainPattern returns a LIKE pattern that matches reverse(name) for names below domain, e.g.
+// ua.vog.elpmaxe.% for example.gov.au. As a prefix match it can use a text_pattern_ops index on
+// reverse(name), where name LIKE '%.example.gov.au' would scan every row.
+func subdomainPattern(domain string) string {
+	return likeEscape(reverseString("."+domain)) + "%"
+}
+
+// domainKeys returns a query for the keys of certs for a domain and its subdomains in cert_index, with the
+// given placeholders for the domain and subdomainPattern(domain)
+func domainKeys(domainArg, patternArg string) string {
+	return "SELECT key FROM cert_index WHERE domain = " + domainArg + " OR reverse(domain) LIKE " + patternArg
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/govau/certwatch/jobs"
+)
+
+const (
+	// slackMaxRequestAge is how old a signed request from Slack can be before we treat it as a replay
+	slackMaxRequestAge = time.Minute * 5
+
+	// slackMaxRequestSize is far larger than any interaction payload
+	slackMaxRequestSize = 1 << 20
+)
+
+var (
+	triageLabels = map[string]string{
+		jobs.TriageAcknowledged: ":white_check_mark: Acknowledged",
+		jobs.TriageExpected:     ":thumbsup: Expected",
+		jobs.TriageInvestigate:  ":mag: Investigating",
+	}
+
+	// triagePagerActions are applied to any incidents paged for the cert
+	triagePagerActions = map[string]string{
+		jobs.TriageAcknowledged: jobs.PagerAcknowledge,
+		jobs.TriageExpected:     jobs.PagerResolve,
+		jobs.TriageInvestigate:  jobs.PagerAcknowledge,
+	}
+)
+
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+	} `json:"user"`
+	Channel struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channel"`
+	ResponseURL string `json:"response_url"`
+	Message     struct {
+		Text   string            `json:"text"`
+		Blocks []json.RawMessage `json:"blocks"`
+	} `json:"message"`
+	Actions []struct {
+		ActionID string `json:"action_id"`
+		BlockID  string `json:"block_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// verifySlackSignature checks the request came from Slack, per https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) bool {
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > slackMaxRequestAge || age < -slackMaxRequestAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:", ts)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// slackActions handles button presses on certwatch Slack messages. Triage responses are recorded
+// in cert_triage, and the original message is updated to show the latest response.
+func (s *server) slackActions(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, slackMaxRequestSize))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !verifySlackSignature(s.SlackSigningSecret, r.Header, body, time.Now()) {
+		http.Error(w, "Bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var si slackInteraction
+	err = json.Unmarshal([]byte(form.Get("payload")), &si)
+	if err != nil {
+		http.Error(w, "Bad payload", http.StatusBadRequest)
+		return
+	}
+
+	for _, a := range si.Actions {
+		// Link buttons are sent here too, nothing to do for those
+		if a.BlockID != jobs.SlackTriageBlockID {
+			continue
+		}
+		label, ok := triageLabels[a.ActionID]
+		if !ok {
+			continue
+		}
+		key, err := base64.RawURLEncoding.DecodeString(a.Value)
+		if err != nil {
+			http.Error(w, "Bad key", http.StatusBadRequest)
+			return
+		}
+
+		userName := si.User.Username
+		if userName == "" {
+			userName = si.User.Name
+		}
+		err = s.recordTriage(key, a.ActionID, si.User.ID, userName, si.Channel.Name)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Error recording response", http.StatusInternalServerError)
+			return
+		}
+
+		if si.ResponseURL != "" {
+			err = updateSlackMessage(si.ResponseURL, si.Message.Text, si.Message.Blocks, fmt.Sprintf("%s by <@%s> at %s", label, si.User.ID, time.Now().Format("2 Jan 2006 15:04 MST")))
+			if err != nil {
+				// The response is recorded, so don't make Slack show an error
+				log.Println(err)
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// recordTriage saves the response, and queues the matching action for any incidents paged for the cert.
+// The cert is also queued to be indexed again, as its OpenSearch document has the latest triage response.
+func (s *server) recordTriage(key []byte, response, userID, userName, channel string) error {
+	bb, err := json.Marshal(&jobs.PagerActionConf{
+		Key:    base64.RawURLEncoding.EncodeToString(key),
+		Action: triagePagerActions[response],
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO cert_triage (key, response, user_id, user_name, channel) VALUES ($1, $2, $3, $4, $5)", key, response, userID, userName, channel)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO opensearch_outbox (key) VALUES ($1) ON CONFLICT DO NOTHING", key)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO que_jobs (job_class, args) SELECT $1::text, $2::json WHERE EXISTS (SELECT 1 FROM pager_incidents WHERE key = $3 AND status != $4)", jobs.KeyPagerAction, bb, key, jobs.IncidentResolved)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateSlackMessage replaces the original message, with the status shown above the triage buttons
+func updateSlackMessage(responseURL, text string, blocks []json.RawMessage, status string) error {
+	statusBlock, err := json.Marshal(map[string]interface{}{
+		"type":     "context",
+		"block_id": jobs.SlackTriageStatusBlockID,
+		"elements": []interface{}{
+			map[string]string{"type": "mrkdwn", "text": status},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var newBlocks []json.RawMessage
+	for _, b := range blocks {
+		var hdr struct {
+			BlockID string `json:"block_id"`
+		}
+		err = json.Unmarshal(b, &hdr)
+		if err != nil {
+			return err
+		}
+		switch hdr.BlockID {
+		case jobs.SlackTriageStatusBlockID:
+			// replaced below
+		case jobs.SlackTriageBlockID:
+			newBlocks = append(newBlocks, statusBlock, b)
+		default:
+			newBlocks = append(newBlocks, b)
+		}
+	}
+
+	bb, err := json.Marshal(map[string]interface{}{
+		"replace_original": true,
+		"text":             text,
+		"blocks":           newBlocks,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := jobs.HTTPClient.Post(responseURL, "application/json", bytes.NewReader(bb))
+	if err != nil {
+		return err
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status updating slack message: %v (%s)", resp.StatusCode, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/rsa"
+	"embed"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+)
+
+const (
+	// webMaxCerts limits how many certs are listed on a page
+	webMaxCerts = 500
+
+	// webRecentCerts is how many of the newest certs are listed on the home page
+	webRecentCerts = 25
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+var templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"date": func(t interface{}) string {
+		switch tt := t.(type) {
+		case time.Time:
+			return tt.UTC().Format("2006-01-02")
+		case *time.Time:
+			if tt != nil {
+				return tt.UTC().Format("2006-01-02")
+			}
+		}
+		return "-"
+	},
+	"datetime": func(t time.Time) string {
+		return t.UTC().Format("2006-01-02 15:04 MST")
+	},
+	"certLink": func(key string) string {
+		return "/cert/" + key
+	},
+	"domainLink": func(domain string) string {
+		return "/domain/" + url.PathEscape(strings.TrimPrefix(domain, "*."))
+	},
+	"issuerLink": func(issuer string) string {
+		return "/issuer?cn=" + url.QueryEscape(issuer)
+	},
+}).ParseFS(templateFS, "templates/*.html"))
+
+// webPage is the data common to every page
+type webPage struct {
+	Title string
+
+	// Q is shown in the search box
+	Q string
+}
+
+// webCert is a cert in a list
+type webCert struct {
+	Key            string
+	Issuer         string
+	Domains        []string
+	NotValidBefore *time.Time
+	NotValidAfter  *time.Time
+	Discovered     time.Time
+	Precert        bool
+	Active         bool
+
+	// BarStyle positions the validity of the cert on a timeline
+	BarStyle template.CSS
+}
+
+type webIssuer struct {
+	Issuer       string
+	Organisation string
+	Total        int64
+	Active       int64
+	Latest       *time.Time
+}
+
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := templates.ExecuteTemplate(w, name, data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// scanWebCerts reads certs selected as: key, issuer_cn, not_valid_before, not_valid_after, discovered, entry_type, domains
+func scanWebCerts(rows *pgx.Rows) ([]*webCert, error) {
+	var rv []*webCert
+	now := time.Now()
+	for rows.Next() {
+		var c webCert
+		var key []byte
+		var entryType string
+		err := rows.Scan(&key, &c.Issuer, &c.NotValidBefore, &c.NotValidAfter, &c.Discovered, &entryType, &c.Domains)
+		if err != nil {
+			return nil, err
+		}
+		c.Key = base64.RawURLEncoding.EncodeToString(key)
+		c.Precert = entryType == "precert"
+		c.Active = c.NotValidBefore != nil && c.NotValidAfter != nil && now.After(*c.NotValidBefore) && now.Before(*c.NotValidAfter)
+		rv = append(rv, &c)
+	}
+	return rv, rows.Err()
+}
+
+const webCertColumns = `
+	s.key, COALESCE(s.issuer_cn, ''), s.not_valid_before, s.not_valid_after, s.discovered, COALESCE(s.entry_type, ''),
+	ARRAY(SELECT i.domain FROM cert_index i WHERE i.key = s.key ORDER BY i.domain)`
+
+// webHome has a search box, and lists the newest certs. Searches go to the domain page.
+func (s *server) webHome(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if q != "" {
+		http.Redirect(w, r, "/domain/"+url.PathEscape(strings.TrimPrefix(q, "*.")), http.StatusFound)
+		return
+	}
+
+	rows, err := s.DB.Query(`SELECT `+webCertColumns+` FROM cert_store s ORDER BY s.discovered DESC LIMIT $1`, webRecentCerts)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	certs, err := scanWebCerts(rows)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad data", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, "home", &struct {
+		webPage
+		Certs []*webCert
+	}{
+		webPage: webPage{Title: "Certificates"},
+		Certs:   certs,
+	})
+}
+
+// webDomain shows all certs for a domain and its subdomains on a timeline, along with those active now
+// and who issued them
+func (s *server) webDomain(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(strings.TrimSpace(mux.Vars(r)["domain"]))
+
+	rows, err := s.DB.Query(`
+		SELECT `+webCertColumns+`
+		FROM cert_store s
+		WHERE s.key IN (`+domainKeys("$1", "$2")+`)
+		ORDER BY s.not_valid_before DESC NULLS LAST
+		LIMIT $3`, domain, subdomainPattern(domain), webMaxCerts)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	certs, err := scanWebCerts(rows)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad data", http.StatusInternalServerError)
+		return
+	}
+	rows.Close()
+
+	// Place each cert on a timeline from the earliest start to the latest end
+	var start, end time.Time
+	for _, c := range certs {
+		if c.NotValidBefore == nil || c.NotValidAfter == nil {
+			continue
+		}
+		if start.IsZero() || c.NotValidBefore.Before(start) {
+			start = *c.NotValidBefore
+		}
+		if c.NotValidAfter.After(end) {
+			end = *c.NotValidAfter
+		}
+	}
+	span := end.Sub(start)
+	var nowStyle template.CSS
+	if span > 0 {
+		for _, c := range certs {
+			if c.NotValidBefore == nil || c.NotValidAfter == nil {
+				continue
+			}
+			left := float64(c.NotValidBefore.Sub(start)) / float64(span) * 100
+			width := float64(c.NotValidAfter.Sub(*c.NotValidBefore)) / float64(span) * 100
+			c.BarStyle = template.CSS(fmt.Sprintf("left: %.2f%%; width: %.2f%%", left, width))
+		}
+		if now := time.Now(); now.After(start) && now.Before(end) {
+			nowStyle = template.CSS(fmt.Sprintf("left: %.2f%%", float64(now.Sub(start))/float64(span)*100))
+		}
+	}
+
+	var active []*webCert
+	for _, c := range certs {
+		if c.Active {
+			active = append(active, c)
+		}
+	}
+
+	rows, err = s.DB.Query(`
+		SELECT COALESCE(s.issuer_cn, ''), COALESCE(s.issuer_o, ''), COUNT(*),
+			COUNT(*) FILTER (WHERE now() BETWEEN s.not_valid_before AND s.not_valid_after), MAX(s.not_valid_before)
+		FROM cert_store s
+		WHERE s.key IN (`+domainKeys("$1", "$2")+`)
+		GROUP BY 1, 2
+		ORDER BY 4 DESC, 3 DESC`, domain, subdomainPattern(domain))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var issuers []*webIssuer
+	for rows.Next() {
+		var i webIssuer
+		err = rows.Scan(&i.Issuer, &i.Organisation, &i.Total, &i.Active, &i.Latest)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Bad data", http.StatusInternalServerError)
+			return
+		}
+		issuers = append(issuers, &i)
+	}
+
+	renderPage(w, "domain", &struct {
+		webPage
+		Domain    string
+		Certs     []*webCert
+		Truncated bool
+		Active    []*webCert
+		Issuers   []*webIssuer
+		Start     time.Time
+		End       time.Time
+		NowStyle  template.CSS
+	}{
+		webPage:   webPage{Title: domain, Q: domain},
+		Domain:    domain,
+		Certs:     certs,
+		Truncated: len(certs) == webMaxCerts,
+		Active:    active,
+		Issuers:   issuers,
+		Start:     start,
+		End:       end,
+		NowStyle:  nowStyle,
+	})
+}
+
+// webIssuers lists issuers, with how many certs they have issued for watched domains
+func (s *server) webIssuers(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.Query(`
+		SELECT COALESCE(issuer_cn, ''), COALESCE(issuer_o, ''), COUNT(*),
+			COUNT(*) FILTER (WHERE now() BETWEEN not_valid_before AND not_valid_after), MAX(not_valid_before)
+		FROM cert_store
+		GROUP BY 1, 2
+		ORDER BY 4 DESC, 3 DESC`)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var issuers []*webIssuer
+	for rows.Next() {
+		var i webIssuer
+		err = rows.Scan(&i.Issuer, &i.Organisation, &i.Total, &i.Active, &i.Latest)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Bad data", http.StatusInternalServerError)
+			return
+		}
+		issuers = append(issuers, &i)
+	}
+
+	renderPage(w, "issuers", &struct {
+		webPage
+		Issuers []*webIssuer
+	}{
+		webPage: webPage{Title: "Issuers"},
+		Issuers: issuers,
+	})
+}
+
+// webIssuer lists the newest certs from an issuer
+func (s *server) webIssuer(w http.ResponseWriter, r *http.Request) {
+	issuer := r.FormValue("cn")
+
+	rows, err := s.DB.Query(`
+		SELECT `+webCertColumns+`
+		FROM cert_store s
+		WHERE COALESCE(s.issuer_cn, '') = $1
+		ORDER BY s.not_valid_before DESC NULLS LAST
+		LIMIT $2`, issuer, webMaxCerts)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	certs, err := scanWebCerts(rows)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad data", http.StatusInternalServerError)
+		return
+	}
+
+	renderPage(w, "issuer", &struct {
+		webPage
+		Issuer    string
+		Certs     []*webCert
+		Truncated bool
+	}{
+		webPage:   webPage{Title: issuer},
+		Issuer:    issuer,
+		Certs:     certs,
+		Truncated: len(certs) == webMaxCerts,
+	})
+}
+
+// lintResult is a problem found with a cert
+type lintResult struct {
+	// Level is error, warning or notice
+	Level   string
+	Message string
+}
+
+// lintCert checks a cert against some of the CA/Browser Forum baseline requirements
+func lintCert(cert *ctx509.Certificate) []*lintResult {
+	var rv []*lintResult
+
+	switch cert.SignatureAlgorithm {
+	case ctx509.MD2WithRSA, ctx509.MD5WithRSA, ctx509.SHA1WithRSA, ctx509.DSAWithSHA1, ctx509.ECDSAWithSHA1:
+		rv = append(rv, &lintResult{Level: "error", Message: fmt.Sprintf("Signed with a weak algorithm: %s", cert.SignatureAlgorithm)})
+	}
+
+	if pk, ok := cert.PublicKey.(*rsa.PublicKey); ok && pk.N.BitLen() < 2048 {
+		rv = append(rv, &lintResult{Level: "error", Message: fmt.Sprintf("RSA key is only %d bits", pk.N.BitLen())})
+	}
+
+	if len(cert.DNSNames) == 0 && len(cert.IPAddresses) == 0 {
+		rv = append(rv, &lintResult{Level: "error", Message: "No subject alternative names"})
+	}
+
+	if cn := strings.ToLower(cert.Subject.CommonName); cn != "" {
+		found := false
+		for _, n := range cert.DNSNames {
+			if strings.ToLower(n) == cn {
+				found = true
+			}
+		}
+		for _, ip := range cert.IPAddresses {
+			if ip.String() == cn {
+				found = true
+			}
+		}
+		if !found {
+			rv = append(rv, &lintResult{Level: "warning", Message: "Common name is not one of the subject alternative names"})
+		}
+	}
+
+	// Certs issued since 1 September 2020 may be valid for at most 398 days
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if !cert.NotBefore.Before(time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)) && lifetime > time.Hour*24*398 {
+		rv = append(rv, &lintResult{Level: "error", Message: fmt.Sprintf("Valid for %d days, more than the 398 allowed", int(lifetime.Hours()/24))})
+	}
+
+	for _, n := range cert.DNSNames {
+		if strings.HasPrefix(n, "*.") {
+			rv = append(rv, &lintResult{Level: "notice", Message: "Wildcard name: " + n})
+		}
+	}
+
+	return rv
+}
+
+// webCertPage shows the decoded cert, its names, validity, checks, the logs we saw it in and any triage.
+// ?format=text gives the plain text dump instead.
+func (s *server) webCertPage(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") == "text" {
+		s.showCert(w, r)
+		return
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, "Bad key", http.StatusBadRequest)
+		return
+	}
+
+	type certName struct {
+		Type, Name string
+		Matched    bool
+	}
+	type certLog struct {
+		URL       string
+		FirstSeen time.Time
+	}
+	type certTriage struct {
+		Response, UserName, Channel string
+		Created                     time.Time
+	}
+	page := struct {
+		webPage
+		Key                                                         string
+		Subject, Issuer, IssuerCN, Serial, SignatureAlgorithm       string
+		KeyType, EntryType, Jurisdiction, CDN, SHA256, SHA1, Status string
+		NotBefore, NotAfter, Discovered                             time.Time
+		DaysLeft                                                    int
+		ElapsedStyle                                                template.CSS
+		Names                                                       []*certName
+		Checks                                                      []*lintResult
+		Logs                                                        []*certLog
+		Triage                                                      []*certTriage
+	}{
+		Key: mux.Vars(r)["key"],
+	}
+
+	var data []byte
+	err = s.DB.QueryRow(`
+		SELECT leaf, COALESCE(issuer_cn, ''), COALESCE(key_type, ''), COALESCE(entry_type, ''), COALESCE(jurisdiction, ''),
+			COALESCE(cdn, ''), COALESCE(fingerprint_sha256, ''), COALESCE(fingerprint_sha1, ''), discovered
+		FROM cert_store WHERE key = $1`, key).Scan(&data, &page.IssuerCN, &page.KeyType, &page.EntryType, &page.Jurisdiction, &page.CDN, &page.SHA256, &page.SHA1, &page.Discovered)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	_, cert, err := parseLeaf(data)
+	if err != nil {
+		http.Error(w, "Bad data", http.StatusInternalServerError)
+		return
+	}
+
+	page.Subject = crtshName(cert.Subject)
+	page.Issuer = crtshName(cert.Issuer)
+	page.Serial = crtshSerial(cert)
+	page.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+	page.NotBefore = cert.NotBefore
+	page.NotAfter = cert.NotAfter
+	page.Checks = lintCert(cert)
+	page.Title = cert.Subject.CommonName
+	if page.Title == "" {
+		page.Title = page.Key
+	}
+
+	now := time.Now()
+	elapsed := 100.0
+	switch {
+	case now.Before(cert.NotBefore):
+		page.Status = "Not yet valid"
+		elapsed = 0
+	case now.After(cert.NotAfter):
+		page.Status = "Expired"
+	default:
+		page.Status = "Valid"
+		page.DaysLeft = int(cert.NotAfter.Sub(now).Hours() / 24)
+		if lifetime := cert.NotAfter.Sub(cert.NotBefore); lifetime > 0 {
+			elapsed = float64(now.Sub(cert.NotBefore)) / float64(lifetime) * 100
+		}
+	}
+	page.ElapsedStyle = template.CSS(fmt.Sprintf("width: %.2f%%", elapsed))
+
+	rows, err := s.DB.Query("SELECT name_type, name, matched FROM cert_names WHERE key = $1 ORDER BY matched DESC, name_type, name", key)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n certName
+		err = rows.Scan(&n.Type, &n.Name, &n.Matched)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Bad data", http.StatusInternalServerError)
+			return
+		}
+		page.Names = append(page.Names, &n)
+	}
+	rows.Close()
+
+	rows, err = s.DB.Query("SELECT log_url, first_seen FROM cert_logs WHERE key = $1 ORDER BY first_seen", key)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l certLog
+		err = rows.Scan(&l.URL, &l.FirstSeen)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Bad data", http.StatusInternalServerError)
+			return
+		}
+		page.Logs = append(page.Logs, &l)
+	}
+	rows.Close()
+
+	rows, err = s.DB.Query("SELECT response, user_name, channel, created FROM cert_triage WHERE key = $1 ORDER BY created", key)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Bad query", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t certTriage
+		err = rows.Scan(&t.Response, &t.UserName, &t.Channel, &t.Created)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Bad data", http.StatusInternalServerError)
+			return
+		}
+		page.Triage = append(page.Triage, &t)
+	}
+	rows.Close()
+
+	renderPage(w, "cert", &page)
+}
+
+// staticHandler serves the embedded static assets under /static/
+func staticHandler() http.Handler {
+	sub, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(sub)))
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -13,11 +16,27 @@ import (
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 
 	"github.com/govau/certwatch/jobs"
+	"github.com/govau/certwatch/migrations"
 	"github.com/govau/cf-common/env"
 	commonjobs "github.com/govau/cf-common/jobs"
 )
 
 func main() {
+	migrateOnly := flag.Bool("migrate-only", false, "apply any pending schema migrations, then exit")
+	reindexOpenSearch := flag.Bool("reindex-opensearch", false, "index every cert in OpenSearch, then exit")
+	flag.Parse()
+
+	pgxConfig := commonjobs.MustPGXConfigFromCloudFoundry()
+
+	// Safe to run from many instances at once, as an advisory lock is held while migrating
+	err := migrations.Run(pgxConfig, log.New(os.Stderr, "", log.LstdFlags))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *migrateOnly {
+		return
+	}
+
 	app, err := cfenv.Current()
 	if err != nil {
 		log.Fatal(err)
@@ -27,14 +46,84 @@ func main() {
 		env.WithUPSLookup(app, "certwatch-ups"),
 	)
 
+	slackHook := envLookup.String("SLACK_HOOK", "")
+	slackInteractive := envLookup.Bool("SLACK_INTERACTIVE")
+	baseMetricsURL := envLookup.String("BASE_METRICS_URL", "")
+
+	expiryThresholds := jobs.DefaultExpiryThresholds
+	if v := envLookup.String("EXPIRY_THRESHOLDS", ""); v != "" {
+		expiryThresholds = nil
+		for _, t := range strings.Split(v, ",") {
+			days, err := strconv.Atoi(strings.TrimSpace(t))
+			if err != nil {
+				log.Fatalf("bad EXPIRY_THRESHOLDS: %s", err)
+			}
+			// 0 is used for lapsed certs, which are always notified
+			if days <= 0 {
+				log.Fatalf("bad EXPIRY_THRESHOLDS: %d, want days greater than 0", days)
+			}
+			expiryThresholds = append(expiryThresholds, days)
+		}
+	}
+
 	dataGovAU := &jobs.UpdateDataGovAU{
 		APIKey:     envLookup.String("CKAN_API_KEY", ""),
 		BaseURL:    envLookup.String("CKAN_BASE_URL", "https://data.gov.au"),
 		ResourceID: envLookup.String("CKAN_RESOURCE_ID", ""),
+		PackageID:  envLookup.String("CKAN_PACKAGE_ID", ""),
+	}
+
+	exportDataset := &jobs.ExportDataset{}
+	if dir := envLookup.String("EXPORT_DIR", ""); dir != "" {
+		exportDataset.Store = &jobs.LocalExportStore{Dir: dir}
+	} else if bucket := envLookup.String("EXPORT_S3_BUCKET", ""); bucket != "" {
+		region := envLookup.String("EXPORT_S3_REGION", "ap-southeast-2")
+		exportDataset.Store = &jobs.S3ExportStore{
+			Endpoint:        envLookup.String("EXPORT_S3_ENDPOINT", "https://s3."+region+".amazonaws.com"),
+			Region:          region,
+			Bucket:          bucket,
+			Prefix:          envLookup.String("EXPORT_S3_PREFIX", ""),
+			AccessKeyID:     envLookup.String("EXPORT_S3_ACCESS_KEY_ID", ""),
+			SecretAccessKey: envLookup.String("EXPORT_S3_SECRET_ACCESS_KEY", ""),
+		}
+	}
+
+	openSearch := &jobs.OpenSearch{
+		URL:      envLookup.String("OPENSEARCH_URL", ""),
+		Index:    envLookup.String("OPENSEARCH_INDEX", "certwatch-certs"),
+		Username: envLookup.String("OPENSEARCH_USERNAME", ""),
+		Password: envLookup.String("OPENSEARCH_PASSWORD", ""),
+		BaseURL:  baseMetricsURL,
+	}
+
+	publishStream := &jobs.PublishStream{
+		Kind:       envLookup.String("STREAM_KIND", jobs.StreamKafka),
+		URL:        envLookup.String("STREAM_URL", ""),
+		Username:   envLookup.String("STREAM_USERNAME", ""),
+		Password:   envLookup.String("STREAM_PASSWORD", ""),
+		Topic:      envLookup.String("STREAM_TOPIC", "certwatch.events"),
+		EventTypes: strings.Split(envLookup.String("STREAM_EVENT_TYPES", jobs.EventNewCert), ","),
+		BaseURL:    baseMetricsURL,
+	}
+
+	if *reindexOpenSearch {
+		if openSearch.URL == "" {
+			log.Fatal("OPENSEARCH_URL must be set to reindex")
+		}
+		pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{ConnConfig: *pgxConfig})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pool.Close()
+		err = openSearch.Reindex(pool, log.New(os.Stderr, "", log.LstdFlags))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	log.Fatal((&commonjobs.Handler{
-		PGXConnConfig: commonjobs.MustPGXConfigFromCloudFoundry(),
+		PGXConnConfig: pgxConfig,
 		WorkerCount:   5,
 		WorkerMap: map[string]*commonjobs.JobConfig{
 			jobs.KeyUpdateLogs: &commonjobs.JobConfig{
@@ -55,9 +144,38 @@ func main() {
 			},
 			jobs.KeyUpdateSlack: &commonjobs.JobConfig{
 				F: (&jobs.UpdateSlack{
-					Hook:    envLookup.String("SLACK_HOOK", ""),
-					BaseURL: envLookup.String("BASE_METRICS_URL", ""),
+					Hook:    slackHook,
+					BaseURL: baseMetricsURL,
+				}).Run,
+			},
+			jobs.KeyNotify: &commonjobs.JobConfig{
+				F: (&jobs.Notify{
+					BaseURL: baseMetricsURL,
+				}).Run,
+			},
+			jobs.KeyPagerAction: &commonjobs.JobConfig{
+				F: (&jobs.PagerAction{
+					BaseURL: baseMetricsURL,
+				}).Run,
+			},
+			jobs.KeyFlushDigests: &commonjobs.JobConfig{
+				F:         jobs.FlushDigests,
+				Singleton: true,
+				Duration:  time.Minute,
+			},
+			jobs.KeySIEMExport: &commonjobs.JobConfig{
+				F: (&jobs.SIEMExport{
+					BaseURL: baseMetricsURL,
 				}).Run,
+				Singleton: true,
+				Duration:  time.Minute,
+			},
+			jobs.KeyCheckExpiry: &commonjobs.JobConfig{
+				F: (&jobs.CheckExpiry{
+					Thresholds: expiryThresholds,
+				}).Run,
+				Singleton: true,
+				Duration:  time.Hour * 24,
 			},
 			jobs.KeyUpdateDataGovAU: &commonjobs.JobConfig{
 				F: dataGovAU.Run,
@@ -65,10 +183,46 @@ func main() {
 			jobs.KeyBackfillDataGovAU: &commonjobs.JobConfig{
 				F: dataGovAU.BackfillDataGovAU,
 			},
+			jobs.KeyFlushCKANOutbox: &commonjobs.JobConfig{
+				F:         dataGovAU.FlushCKANOutbox,
+				Singleton: true,
+				Duration:  time.Minute,
+			},
+			jobs.KeyReconcileDataGovAU: &commonjobs.JobConfig{
+				F:         dataGovAU.ReconcileDataGovAU,
+				Singleton: true,
+				Duration:  time.Hour * 24,
+			},
+			jobs.KeyBootstrapDataGovAU: &commonjobs.JobConfig{
+				F:         dataGovAU.BootstrapDataGovAU,
+				Singleton: true,
+			},
+			jobs.KeyFlushOpenSearchOutbox: &commonjobs.JobConfig{
+				F:         openSearch.FlushOpenSearchOutbox,
+				Singleton: true,
+				Duration:  time.Minute,
+			},
+			jobs.KeyPublishStream: &commonjobs.JobConfig{
+				F:         publishStream.Run,
+				Singleton: true,
+				Duration:  time.Second * 5,
+			},
+			jobs.KeyExportDataset: &commonjobs.JobConfig{
+				F:         exportDataset.Run,
+				Singleton: true,
+				Duration:  time.Hour * 24,
+			},
+			jobs.KeyExportFullDataset: &commonjobs.JobConfig{
+				F:         exportDataset.RunFull,
+				Singleton: true,
+			},
 			jobs.KeyUpdateMetadata: &commonjobs.JobConfig{
 				F:         jobs.RefreshMetadataForEntries,
 				Singleton: true,
 			},
+			jobs.KeyUpdateMetadataRange: &commonjobs.JobConfig{
+				F: jobs.RefreshMetadataForRange,
+			},
 		},
 		OnStart: func(qc *que.Client, pgxPool *pgx.ConnPool, logger *log.Logger) error {
 			err := qc.Enqueue(&que.Job{
@@ -80,6 +234,108 @@ func main() {
 				return err
 			}
 
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyFlushDigests,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeySIEMExport,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyCheckExpiry,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			// Keep the legacy SLACK_HOOK working, by making sure it is a notification channel
+			if slackHook != "" {
+				_, err = pgxPool.Exec(`
+					INSERT INTO notification_channels (name, kind, config)
+					VALUES ($1, $2, jsonb_build_object('url', $3::text, 'interactive', $4::boolean))
+					ON CONFLICT (name) DO UPDATE SET kind = EXCLUDED.kind, config = EXCLUDED.config`, "SLACK_HOOK", jobs.ChannelSlack, slackHook, slackInteractive)
+				if err != nil {
+					return err
+				}
+
+				// and if it has no subscriptions, that it gets everything, as it always has
+				_, err = pgxPool.Exec(`
+					INSERT INTO notification_subscriptions (channel_id, match_type)
+					SELECT c.id, $2 FROM notification_channels c
+					WHERE c.name = $1 AND NOT EXISTS (SELECT 1 FROM notification_subscriptions s WHERE s.channel_id = c.id)`, "SLACK_HOOK", jobs.MatchAll)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Creates the CKAN datastore, or adds new fields to it
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyBootstrapDataGovAU,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyFlushCKANOutbox,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyReconcileDataGovAU,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyFlushOpenSearchOutbox,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyPublishStream,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			err = qc.Enqueue(&que.Job{
+				Type:  jobs.KeyExportDataset,
+				Args:  []byte("{}"),
+				RunAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
 			// Handles migration
 			err = qc.Enqueue(&que.Job{
 				Type:  jobs.KeyUpdateMetadata,
@@ -97,38 +353,5 @@ func main() {
 
 			return nil
 		},
-		InitSQL: `
-			CREATE TABLE IF NOT EXISTS monitored_logs (
-				url       text      PRIMARY KEY,
-				processed bigint    NOT NULL DEFAULT 0,
-				state     integer   NOT NULL DEFAULT 0,
-				connect_url text
-			);
-
-			CREATE TABLE IF NOT EXISTS cert_store (
-				key              bytea                     PRIMARY KEY,
-				leaf             bytea                     NOT NULL,
-				not_valid_before timestamp with time zone,
-				not_valid_after  timestamp with time zone,
-				issuer_cn        text,
-				jurisdiction     text,
-				cdn              text,
-				needs_update     boolean,
-				discovered       timestamptz               NOT NULL DEFAULT now(),
-				needs_ckan_backfill boolean
-			);
-
-			CREATE TABLE IF NOT EXISTS cert_index (
-				key          bytea         NOT NULL,
-				domain       text          NOT NULL,
-
-				CONSTRAINT cert_index_pkey PRIMARY KEY (key, domain)
-			);
-
-			CREATE TABLE IF NOT EXISTS error_log (
-				discovered   timestamptz   NOT NULL DEFAULT now(),
-				error        text          NOT NULL
-			);
-		`,
 	}).WorkForever())
 }
@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/jackc/pgx"
+)
+
+// Name types stored in cert_names
+const (
+	NameTypeCN    = "cn"
+	NameTypeDNS   = "dns"
+	NameTypeIP    = "ip"
+	NameTypeEmail = "email"
+)
+
+// CertName is a single name a certificate is valid for, as stored in cert_names
+type CertName struct {
+	Type string
+	Name string
+
+	// Matched is true if the name is one we watch for (see IsMatchingDomain)
+	Matched bool
+}
+
+// IsMatchingDomain returns true if the domain is one we are monitoring
+func IsMatchingDomain(name string) bool {
+	return strings.HasSuffix(name, DomainSuffix) || name == MatchDomain
+}
+
+// leafCertificate returns the (possibly partially parsed) certificate or precertificate in the leaf, or nil.
+func leafCertificate(leaf *ct.MerkleTreeLeaf) *ctx509.Certificate {
+	var cert *ctx509.Certificate
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		// swallow errors, as this parser is will still return partially valid certs, which are good enough for our analysis
+		cert, _ = leaf.X509Certificate()
+	case ct.PrecertLogEntryType:
+		cert, _ = leaf.Precertificate()
+	}
+	return cert
+}
+
+// CertNames returns every subject common name, DNS, IP and email SAN in the certificate, whether or not it matches.
+func CertNames(cert *ctx509.Certificate) []*CertName {
+	if cert == nil {
+		return nil
+	}
+
+	var rv []*CertName
+	seen := make(map[CertName]bool)
+	add := func(t, name string, matched bool) {
+		cn := CertName{Type: t, Name: name, Matched: matched}
+		if name == "" || seen[cn] {
+			return
+		}
+		seen[cn] = true
+		rv = append(rv, &cn)
+	}
+
+	add(NameTypeCN, cert.Subject.CommonName, IsMatchingDomain(cert.Subject.CommonName))
+	for _, name := range cert.DNSNames {
+		add(NameTypeDNS, name, IsMatchingDomain(name))
+	}
+	for _, ip := range cert.IPAddresses {
+		add(NameTypeIP, ip.String(), false)
+	}
+	for _, email := range cert.EmailAddresses {
+		add(NameTypeEmail, email, IsMatchingDomain(email[strings.LastIndex(email, "@")+1:]))
+	}
+	return rv
+}
+
+// certNameBatch accumulates names for many certs, so that they can be written in a single statement
+type certNameBatch struct {
+	keys    [][]byte
+	types   []string
+	names   []string
+	matched []bool
+}
+
+func (b *certNameBatch) Add(key []byte, names []*CertName) {
+	for _, n := range names {
+		b.keys = append(b.keys, key)
+		b.types = append(b.types, n.Type)
+		b.names = append(b.names, n.Name)
+		b.matched = append(b.matched, n.Matched)
+	}
+}
+
+// Store writes the batch to cert_names. Arrays are used rather than a VALUES list, as certs
+// can have hundreds of SANs each which would quickly exceed the limit on bind parameters.
+func (b *certNameBatch) Store(tx *pgx.Tx) error {
+	if len(b.keys) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO cert_names (key, name_type, name, matched)
+		SELECT * FROM unnest($1::bytea[], $2::text[], $3::text[], $4::boolean[])
+		ON CONFLICT (key, name_type, name) DO UPDATE SET matched = EXCLUDED.matched`, b.keys, b.types, b.names, b.matched)
+	return err
+}
@@ -0,0 +1,231 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyBootstrapDataGovAU = "bootstrap_data_gov_au"
+
+	// CKANPrimaryKey is the primary key of the datastore
+	CKANPrimaryKey = "key"
+
+	// CKANResourceName is used when we create the resource ourselves
+	CKANResourceName = "Certificates for gov.au domains"
+)
+
+var (
+	// CKANFields is the datastore schema, which must match the records made by scanCKANRecord.
+	// Fields can be added, and will be added to an existing datastore by BootstrapDataGovAU, but
+	// existing fields should not be changed or removed.
+	CKANFields = []ckanField{
+		{ID: "key", Type: "text"},
+		{ID: "issuer_cn", Type: "text"},
+		{ID: "domains", Type: "text[]"},
+		{ID: "not_valid_before", Type: "timestamp"},
+		{ID: "not_valid_after", Type: "timestamp"},
+		{ID: "raw_data", Type: "text"},
+		{ID: "jurisdiction", Type: "text"},
+		{ID: "cdn", Type: "text"},
+		{ID: "entry_type", Type: "text"},
+		{ID: "fingerprint_sha256", Type: "text"},
+		{ID: "fingerprint_sha1", Type: "text"},
+		{ID: "key_type", Type: "text"},
+		{ID: "issuer_o", Type: "text"},
+		{ID: "discovered", Type: "timestamp"},
+		{ID: "logs", Type: "text[]"},
+	}
+
+	// errCKANResourceUnknown is returned until BootstrapDataGovAU has created a resource
+	errCKANResourceUnknown = errors.New("no CKAN resource, waiting for bootstrap_data_gov_au to create one")
+)
+
+// ckanError is returned by the CKAN action API when success is false
+type ckanError struct {
+	StatusCode int
+	Type       string `json:"__type"`
+	Message    string `json:"message"`
+}
+
+func (e *ckanError) Error() string {
+	return fmt.Sprintf("CKAN error %v: %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+func (e *ckanError) notFound() bool {
+	return e.Type == "Not Found Error"
+}
+
+// transient is true for errors where the same request may work later
+func (e *ckanError) transient() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ckanAction calls a CKAN action API, unmarshalling the result into result (if not nil)
+func (us *UpdateDataGovAU) ckanAction(action string, payload, result interface{}) error {
+	bb, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, us.BaseURL+"/api/3/action/"+action, bytes.NewReader(bb))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", us.APIKey)
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var rv struct {
+		Success bool            `json:"success"`
+		Result  json.RawMessage `json:"result"`
+		Error   *ckanError      `json:"error"`
+	}
+	err = json.Unmarshal(body, &rv)
+	if err != nil {
+		// e.g. a rate limit or gateway error, from something in front of CKAN
+		return &ckanError{StatusCode: resp.StatusCode, Type: "Bad Response", Message: string(body)}
+	}
+	if !rv.Success || resp.StatusCode != http.StatusOK {
+		if rv.Error == nil {
+			rv.Error = &ckanError{}
+		}
+		rv.Error.StatusCode = resp.StatusCode
+		return rv.Error
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(rv.Result, result)
+}
+
+// resourceID is the configured CKAN resource, or the one created by BootstrapDataGovAU
+func (us *UpdateDataGovAU) resourceID(tx *pgx.Tx) (string, error) {
+	if us.ResourceID != "" {
+		return us.ResourceID, nil
+	}
+
+	var rv string
+	err := tx.QueryRow("SELECT resource_id FROM ckan_resources WHERE base_url = $1 AND package_id = $2", us.BaseURL, us.PackageID).Scan(&rv)
+	if err == pgx.ErrNoRows {
+		return "", errCKANResourceUnknown
+	}
+	return rv, err
+}
+
+// BootstrapDataGovAU makes sure the CKAN datastore exists with all of CKANFields. If no resource ID is
+// configured, a resource is created in the configured package, and its ID saved in ckan_resources.
+func (us *UpdateDataGovAU) BootstrapDataGovAU(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	// If we don't use data.gov.au, fail fast
+	if us.APIKey == "" {
+		return nil
+	}
+
+	resourceID, err := us.resourceID(tx)
+	if err == errCKANResourceUnknown {
+		if us.PackageID == "" {
+			return errors.New("one of CKAN_RESOURCE_ID or CKAN_PACKAGE_ID must be set")
+		}
+
+		var created struct {
+			ResourceID string `json:"resource_id"`
+		}
+		err = us.ckanAction("datastore_create", map[string]interface{}{
+			"resource": map[string]interface{}{
+				"package_id": us.PackageID,
+				"name":       CKANResourceName,
+			},
+			"fields":      CKANFields,
+			"primary_key": CKANPrimaryKey,
+		}, &created)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO ckan_resources (base_url, package_id, resource_id) VALUES ($1, $2, $3)", us.BaseURL, us.PackageID, created.ResourceID)
+		if err != nil {
+			return err
+		}
+
+		logger.Printf("Created CKAN resource %s in package %s", created.ResourceID, us.PackageID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var existing struct {
+		Fields []ckanField `json:"fields"`
+	}
+	err = us.ckanAction("datastore_search", map[string]interface{}{
+		"resource_id": resourceID,
+		"limit":       0,
+	}, &existing)
+	if ce, ok := err.(*ckanError); ok && ce.notFound() {
+		// The resource exists, but has no datastore yet
+		err = us.ckanAction("datastore_create", map[string]interface{}{
+			"resource_id": resourceID,
+			"fields":      CKANFields,
+			"primary_key": CKANPrimaryKey,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Created CKAN datastore for resource %s", resourceID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	have := make(map[string]bool)
+	for _, f := range existing.Fields {
+		have[f.ID] = true
+	}
+	fields := existing.Fields
+	var added []string
+	for _, f := range CKANFields {
+		if !have[f.ID] {
+			fields = append(fields, f)
+			added = append(added, f.ID)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	// datastore_create on an existing datastore adds any new fields. The internal _id field is not ours to pass.
+	var toCreate []ckanField
+	for _, f := range fields {
+		if f.ID != "_id" {
+			toCreate = append(toCreate, f)
+		}
+	}
+	err = us.ckanAction("datastore_create", map[string]interface{}{
+		"resource_id": resourceID,
+		"fields":      toCreate,
+		"primary_key": CKANPrimaryKey,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Added fields %v to CKAN resource %s", added, resourceID)
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+// Values for notification_deliveries.status
+const (
+	DeliveryPending  = "pending"
+	DeliveryRetrying = "retrying"
+	DeliverySent     = "sent"
+	DeliveryFailed   = "failed"
+
+	// DeliveryDigested means the event was added to a digest, which has a delivery of its own
+	DeliveryDigested = "digested"
+
+	// DeliveryDropped means the channel was disabled before it could be sent
+	DeliveryDropped = "dropped"
+)
+
+const (
+	// MaxDeliveryAttempts is how many times we try to send a notification before marking it failed.
+	// Rate limited attempts don't count.
+	MaxDeliveryAttempts = 10
+)
+
+// retryBackoff is how long to wait after a failed attempt, the same as que uses for failed jobs
+func retryBackoff(attempts int) time.Duration {
+	return time.Duration(attempts*attempts*attempts*attempts+3) * time.Second
+}
+
+// enqueueNotify records a pending delivery of the event to the channel, and queues the job to send it
+func enqueueNotify(qc *que.Client, tx *pgx.Tx, channelID int64, ev *Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	if ev.Cert != nil {
+		key, err = base64.RawURLEncoding.DecodeString(ev.Cert.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	var deliveryID int64
+	err = tx.QueryRow(`
+		INSERT INTO notification_deliveries (channel_id, event_id, event_type, key, payload, status)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`, channelID, ev.ID, ev.Type, key, payload, DeliveryPending).Scan(&deliveryID)
+	if err != nil {
+		return err
+	}
+
+	bb, err := json.Marshal(&NotifyConf{
+		ChannelID:  channelID,
+		DeliveryID: deliveryID,
+		Event:      ev,
+	})
+	if err != nil {
+		return err
+	}
+	return qc.EnqueueInTx(&que.Job{
+		Type: KeyNotify,
+		Args: bb,
+	}, tx)
+}
+
+// setDeliveryStatus records the outcome of an attempt to deliver, returning how many attempts have been made.
+// responseCode and sendErr are from the notifier, with 0 meaning there was no response.
+func setDeliveryStatus(tx *pgx.Tx, deliveryID int64, status string, attempted bool, responseCode int, sendErr error) (int, error) {
+	var lastError *string
+	if sendErr != nil {
+		s := sendErr.Error()
+		lastError = &s
+	}
+	var code *int32
+	if responseCode != 0 {
+		c := int32(responseCode)
+		code = &c
+	}
+
+	increment := 0
+	if attempted {
+		increment = 1
+	}
+
+	var attempts int
+	err := tx.QueryRow(`
+		UPDATE notification_deliveries SET
+			status = $2,
+			attempts = attempts + $3,
+			response_code = COALESCE($4, response_code),
+			last_error = COALESCE($5, last_error),
+			updated = now()
+		WHERE id = $1
+		RETURNING attempts`, deliveryID, status, increment, code, lastError).Scan(&attempts)
+	if err == pgx.ErrNoRows {
+		// Deleted along with its channel
+		return 0, nil
+	}
+	return attempts, err
+}
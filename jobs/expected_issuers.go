@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/jackc/pgx"
+)
+
+// issuerNames returns the common names and organisations of the cert's issuer, and of every cert
+// in the chain submitted with it, so that an expected issuer can name an intermediate, root or organisation.
+func issuerNames(cert *ctx509.Certificate, entryType ct.LogEntryType, extraData []byte) []string {
+	var rv []string
+	if cert != nil {
+		rv = append(rv, cert.Issuer.CommonName)
+		rv = append(rv, cert.Issuer.Organization...)
+	}
+
+	var chain []ct.ASN1Cert
+	switch entryType {
+	case ct.X509LogEntryType:
+		var cc ct.CertificateChain
+		if _, err := cttls.Unmarshal(extraData, &cc); err == nil {
+			chain = cc.Entries
+		}
+	case ct.PrecertLogEntryType:
+		var pce ct.PrecertChainEntry
+		if _, err := cttls.Unmarshal(extraData, &pce); err == nil {
+			chain = pce.CertificateChain
+		}
+	}
+
+	for _, c := range chain {
+		// swallow errors, as this parser is will still return partially valid certs, which are good enough for our analysis
+		ic, _ := ctx509.ParseCertificate(c.Data)
+		if ic == nil {
+			continue
+		}
+		rv = append(rv, ic.Subject.CommonName)
+		rv = append(rv, ic.Subject.Organization...)
+	}
+
+	return rv
+}
+
+// checkExpectedIssuers applies the most specific expected_issuers policy covering each domain, and if the
+// cert's issuer (or its chain) isn't on the list, returns a description of the violation. Returns the empty
+// string if there is no violation.
+func checkExpectedIssuers(tx *pgx.Tx, domains, issuers []string) (string, error) {
+	rows, err := tx.Query(`
+		SELECT d, o.suffix, o.issuer
+		FROM unnest($1::text[]) d
+		JOIN expected_issuers o ON lower(d) = o.suffix OR right(lower(d), length(o.suffix) + 1) = '.' || o.suffix
+		ORDER BY d, length(o.suffix) DESC, o.issuer`, domains)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	// domain -> most specific suffix -> allowed issuers. Several domains can share a suffix, so each of
+	// its issuers is only added once.
+	policy := make(map[string]string)
+	allowed := make(map[string][]string)
+	added := make(map[[2]string]bool)
+	for rows.Next() {
+		var domain, suffix, issuer string
+		err = rows.Scan(&domain, &suffix, &issuer)
+		if err != nil {
+			return "", err
+		}
+		if s, ok := policy[domain]; ok && s != suffix {
+			continue // we've already seen a longer suffix for this domain
+		}
+		policy[domain] = suffix
+		if !added[[2]string{suffix, issuer}] {
+			added[[2]string{suffix, issuer}] = true
+			allowed[suffix] = append(allowed[suffix], issuer)
+		}
+	}
+	rows.Close()
+
+	var violations []string
+	for domain, suffix := range policy {
+		if !anyEqualFold(allowed[suffix], issuers) {
+			violations = append(violations, fmt.Sprintf("%s (%s expects %s)", domain, suffix, strings.Join(allowed[suffix], ", ")))
+		}
+	}
+	if len(violations) == 0 {
+		return "", nil
+	}
+	sort.Strings(violations)
+
+	return fmt.Sprintf("Not an expected issuer for: %s", strings.Join(violations, "; ")), nil
+}
+
+func anyEqualFold(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if strings.EqualFold(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package jobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportUploadTimeout limits how long uploading one export file to S3 can take
+const ExportUploadTimeout = time.Hour
+
+// ExportStore is somewhere that dataset exports are written to
+type ExportStore interface {
+	// Put stores the file at the path (slash separated). checksum is the hex SHA-256 of its contents.
+	Put(name string, f *os.File, size int64, checksum string) error
+
+	// Location describes where a file is stored, for logs and the exports table
+	Location(name string) string
+}
+
+// LocalExportStore writes exports under a directory
+type LocalExportStore struct {
+	Dir string
+}
+
+func (ls *LocalExportStore) Location(name string) string {
+	return filepath.Join(ls.Dir, filepath.FromSlash(name))
+}
+
+func (ls *LocalExportStore) Put(name string, f *os.File, size int64, checksum string) error {
+	dest := ls.Location(name)
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary name first, so that readers never see a partial file
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(out, f)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// S3ExportStore writes exports to an S3 compatible bucket, such as MinIO, using path style
+// URLs and AWS Signature Version 4
+type S3ExportStore struct {
+	// Endpoint is e.g. https://s3.ap-southeast-2.amazonaws.com, or http://localhost:9000 for MinIO
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+func (ss *S3ExportStore) key(name string) string {
+	if ss.Prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(ss.Prefix, "/") + "/" + name
+}
+
+func (ss *S3ExportStore) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", ss.Bucket, ss.key(name))
+}
+
+// s3EscapePath URI encodes everything but unreserved characters and slashes, as S3 expects in the canonical request
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// s3Authorization returns the AWS Signature Version 4 Authorization header for an S3 request without a
+// query string. headers are the headers to sign besides host, keyed by lower case name, and must include
+// x-amz-date (e.g. 20130524T000000Z) and x-amz-content-sha256.
+func s3Authorization(method, host, path string, headers map[string]string, region, accessKeyID, secretAccessKey string) string {
+	names := []string{"host"}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		v := host
+		if k != "host" {
+			v = strings.TrimSpace(headers[k])
+		}
+		canonicalHeaders.WriteString(k + ":" + v + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+
+	amzDate := headers["x-amz-date"]
+	day := amzDate[:8]
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(crHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), day)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature)
+}
+
+func (ss *S3ExportStore) Put(name string, f *os.File, size int64, payloadHash string) error {
+	endpoint, err := url.Parse(ss.Endpoint)
+	if err != nil {
+		return err
+	}
+	path := "/" + ss.Bucket + "/" + s3EscapePath(ss.key(name))
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, endpoint.Scheme+"://"+endpoint.Host+path, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	headers := map[string]string{
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           time.Now().UTC().Format("20060102T150405Z"),
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Authorization", s3Authorization(http.MethodPut, endpoint.Host, path, headers, ss.Region, ss.AccessKeyID, ss.SecretAccessKey))
+
+	// Uploads can be large, so take the shared client's settings with a longer timeout
+	client := *HTTPClient
+	client.Timeout = ExportUploadTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status from %s: %v (%s)", endpoint.Host, resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package jobs
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPTimeout limits how long a request to another service can take, including reading the response
+const HTTPTimeout = time.Minute
+
+// HTTPClient is used for requests to notifiers, CKAN, OpenSearch, stream brokers and export stores, so
+// that a server that hangs can't hold up a job, and the lock on its queue row, forever
+var HTTPClient = &http.Client{Timeout: HTTPTimeout}
@@ -0,0 +1,148 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyCheckExpiry = "cron_check_expiry"
+
+	// ExpiryLapseLookback is how long after lapsing we'll still notify about a domain. Without this,
+	// the first run would notify about every domain that has ever lapsed.
+	ExpiryLapseLookback = time.Hour * 24 * 7
+)
+
+var (
+	// DefaultExpiryThresholds are the days before expiry at which we warn
+	DefaultExpiryThresholds = []int{30, 14, 7}
+)
+
+// CheckExpiry warns about domains whose newest cert is about to expire, or has just expired, without a
+// replacement having been issued. Each domain is notified at most once per threshold per expiry date,
+// as recorded in expiry_notifications.
+type CheckExpiry struct {
+	// Thresholds are in days
+	Thresholds []int
+}
+
+type expiringDomain struct {
+	domain       string
+	key          []byte
+	notBefore    time.Time
+	notAfter     time.Time
+	issuer       string
+	jurisdiction string
+	cdn          string
+}
+
+// threshold returns the smallest threshold that has been crossed, 0 if lapsed, or -1 if none have
+func (ce *CheckExpiry) threshold(notAfter, now time.Time) int {
+	if !notAfter.After(now) {
+		return 0
+	}
+	thresholds := append([]int(nil), ce.Thresholds...)
+	sort.Ints(thresholds)
+	for _, t := range thresholds {
+		if notAfter.Sub(now) <= time.Duration(t)*time.Hour*24 {
+			return t
+		}
+	}
+	return -1
+}
+
+func (ce *CheckExpiry) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	maxThreshold := 0
+	for _, t := range ce.Thresholds {
+		if t > maxThreshold {
+			maxThreshold = t
+		}
+	}
+
+	now := time.Now()
+	rows, err := tx.Query(`
+		SELECT domain, key, not_valid_before, not_valid_after, issuer_cn, jurisdiction, cdn FROM (
+			SELECT DISTINCT ON (i.domain) i.domain, s.key, s.not_valid_before, s.not_valid_after, COALESCE(s.issuer_cn, '') issuer_cn, COALESCE(s.jurisdiction, '') jurisdiction, COALESCE(s.cdn, '') cdn
+			FROM cert_index i
+			JOIN cert_store s ON s.key = i.key
+			WHERE s.not_valid_before IS NOT NULL AND s.not_valid_after IS NOT NULL
+			ORDER BY i.domain, s.not_valid_after DESC
+		) newest
+		WHERE not_valid_after > $1 AND not_valid_after <= $2`, now.Add(-ExpiryLapseLookback), now.Add(time.Duration(maxThreshold)*time.Hour*24))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var expiring []*expiringDomain
+	for rows.Next() {
+		var ed expiringDomain
+		err = rows.Scan(&ed.domain, &ed.key, &ed.notBefore, &ed.notAfter, &ed.issuer, &ed.jurisdiction, &ed.cdn)
+		if err != nil {
+			return err
+		}
+		expiring = append(expiring, &ed)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, ed := range expiring {
+		t := ce.threshold(ed.notAfter, now)
+		if t < 0 {
+			continue
+		}
+
+		rows, err := tx.Query("INSERT INTO expiry_notifications (domain, threshold, not_valid_after) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING RETURNING domain", ed.domain, t, ed.notAfter)
+		if err != nil {
+			return err
+		}
+		isNew := rows.Next()
+		rows.Close()
+		if !isNew {
+			continue
+		}
+
+		owners, err := lookupOwners(tx, []string{ed.domain})
+		if err != nil {
+			return err
+		}
+
+		eventType := EventExpiring
+		if t == 0 {
+			eventType = EventLapsed
+		}
+		ev := newEvent(eventType, ed.domain, strconv.Itoa(t), ed.notAfter.Format(time.RFC3339))
+		ev.Cert = &CertInfo{
+			Key:          base64.RawURLEncoding.EncodeToString(ed.key),
+			Domains:      []string{ed.domain},
+			Issuer:       ed.issuer,
+			Jurisdiction: ed.jurisdiction,
+			CDN:          ed.cdn,
+			NotBefore:    ed.notBefore,
+			NotAfter:     ed.notAfter,
+			Owners:       owners,
+		}
+		if t == 0 {
+			ev.Reason = fmt.Sprintf("The newest certificate for %s expired on %s, and no replacement has been issued.", ed.domain, ed.notAfter.Format(time.RFC1123))
+		} else {
+			ev.Reason = fmt.Sprintf("The newest certificate for %s expires in %d days on %s, and no replacement has been issued.", ed.domain, int(ed.notAfter.Sub(now).Hours()/24), ed.notAfter.Format(time.RFC1123))
+		}
+
+		err = enqueueNotifications(qc, tx, ev)
+		if err != nil {
+			return err
+		}
+		sent++
+	}
+
+	logger.Printf("Found %d domains with expiring certs, notified %d", len(expiring), sent)
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package jobs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/govau/cf-common/jobs"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyExportDataset     = "cron_export_dataset"
+	KeyExportFullDataset = "export_dataset_full"
+
+	// Values for dataset_exports.kind
+	ExportFull        = "full"
+	ExportIncremental = "incremental"
+
+	exportDateFormat = "2006-01-02"
+
+	// ExportSafetyLag is how long after the end of a day we wait before exporting it. discovered is the
+	// start time of the transaction that stored the cert, so certs can appear in a day shortly after it ends.
+	ExportSafetyLag = time.Hour
+)
+
+// ExportDataset writes the certificate dataset, with the same fields as CKAN, as CSV, JSON Lines and
+// Parquet files, along with a manifest. Full snapshots include every cert discovered before the start of
+// the current UTC day, and incrementals those discovered during a UTC day. Days are only exported once
+// ExportSafetyLag has passed since they ended.
+type ExportDataset struct {
+	// Store is where exports are written. If nil, exports are disabled.
+	Store ExportStore
+}
+
+// ExportManifest is written alongside each export, once all of its files have been written
+type ExportManifest struct {
+	Kind        string        `json:"kind"`
+	PeriodStart *time.Time    `json:"period_start"`
+	PeriodEnd   time.Time     `json:"period_end"`
+	Generated   time.Time     `json:"generated"`
+	Rows        int64         `json:"rows"`
+	Fields      []ckanField   `json:"fields"`
+	Files       []*ExportFile `json:"files"`
+}
+
+// ExportFile describes a file in an export
+type ExportFile struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+
+	f *os.File
+	h hash.Hash
+	w *bufio.Writer
+}
+
+func (ef *ExportFile) Write(p []byte) (int, error) {
+	n, err := ef.w.Write(p)
+	ef.Bytes += int64(n)
+	return n, err
+}
+
+// startOfDay is midnight UTC at the start of the day containing t
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour * 24)
+}
+
+// exportableUntil is the end of the last day that can be exported, allowing for ExportSafetyLag
+func exportableUntil(now time.Time) time.Time {
+	return startOfDay(now.Add(-ExportSafetyLag))
+}
+
+// Run is the cron job. The first run writes a full snapshot, and later runs write an incremental
+// for each complete day since the last incremental (or that first snapshot), committing after each.
+// Full snapshots written on demand don't move the incrementals on, so there are no gaps between them.
+func (ed *ExportDataset) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	if ed.Store == nil {
+		return nil
+	}
+
+	until := exportableUntil(time.Now())
+
+	var last *time.Time
+	err := tx.QueryRow(`
+		SELECT COALESCE(MAX(period_end) FILTER (WHERE kind = $1), MIN(period_end) FILTER (WHERE kind = $2))
+		FROM dataset_exports`, ExportIncremental, ExportFull).Scan(&last)
+	if err != nil {
+		return err
+	}
+
+	if last == nil {
+		return ed.export(logger, tx, ExportFull, nil, until)
+	}
+
+	from := startOfDay(*last)
+	if !from.Before(until) {
+		return nil
+	}
+	to := from.Add(time.Hour * 24)
+	err = ed.export(logger, tx, ExportIncremental, &from, to)
+	if err != nil {
+		return err
+	}
+
+	if to.Before(until) {
+		// Commit, and come straight back for the next day
+		return jobs.ErrImmediateReschedule
+	}
+
+	// Returning nil will commit and reschedule via cron
+	return nil
+}
+
+// RunFull writes a full snapshot on demand
+func (ed *ExportDataset) RunFull(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	if ed.Store == nil {
+		return nil
+	}
+	return ed.export(logger, tx, ExportFull, nil, exportableUntil(time.Now()))
+}
+
+// exportText formats a CKAN record value for CSV and Parquet
+func exportText(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return vv
+	case []byte:
+		return base64.StdEncoding.EncodeToString(vv)
+	case time.Time:
+		return vv.UTC().Format(time.RFC3339)
+	case *time.Time:
+		if vv == nil {
+			return ""
+		}
+		return vv.UTC().Format(time.RFC3339)
+	case []string:
+		return strings.Join(vv, ",")
+	default:
+		return fmt.Sprint(vv)
+	}
+}
+
+// exportTime converts a CKAN record value for a Parquet timestamp column
+func exportTime(v interface{}) *time.Time {
+	switch vv := v.(type) {
+	case time.Time:
+		return &vv
+	case *time.Time:
+		return vv
+	default:
+		return nil
+	}
+}
+
+func (ed *ExportDataset) newFile(name, format string) (*ExportFile, error) {
+	f, err := ioutil.TempFile("", "certwatch-export-")
+	if err != nil {
+		return nil, err
+	}
+	ef := &ExportFile{Name: name, Format: format, f: f, h: sha256.New()}
+	ef.w = bufio.NewWriter(io.MultiWriter(f, ef.h))
+	return ef, nil
+}
+
+// finish flushes the file, and stores it under dir
+func (ed *ExportDataset) finish(ef *ExportFile, dir string) error {
+	err := ef.w.Flush()
+	if err != nil {
+		return err
+	}
+	ef.SHA256 = hex.EncodeToString(ef.h.Sum(nil))
+	return ed.Store.Put(dir+"/"+ef.Name, ef.f, ef.Bytes, ef.SHA256)
+}
+
+// export writes the certs discovered in the period. Files are written to temporary files first, so that
+// their checksums are known when they are stored. The manifest is stored last.
+func (ed *ExportDataset) export(logger *log.Logger, tx *pgx.Tx, kind string, from *time.Time, to time.Time) error {
+	dir := kind + "/" + to.Format(exportDateFormat)
+	if from != nil {
+		dir = kind + "/" + from.Format(exportDateFormat)
+	}
+
+	csvFile, err := ed.newFile("certs.csv", "csv")
+	if err != nil {
+		return err
+	}
+	jsonFile, err := ed.newFile("certs.jsonl", "jsonl")
+	if err != nil {
+		return err
+	}
+	parquetFile, err := ed.newFile("certs.parquet", "parquet")
+	if err != nil {
+		return err
+	}
+	files := []*ExportFile{csvFile, jsonFile, parquetFile}
+	defer func() {
+		for _, ef := range files {
+			ef.f.Close()
+			os.Remove(ef.f.Name())
+		}
+	}()
+
+	var header []string
+	var columns []ParquetColumn
+	for _, f := range CKANFields {
+		header = append(header, f.ID)
+		colKind := ParquetString
+		if f.Type == "timestamp" {
+			colKind = ParquetTimestamp
+		}
+		columns = append(columns, ParquetColumn{Name: f.ID, Kind: colKind})
+	}
+
+	cw := csv.NewWriter(csvFile)
+	err = cw.Write(header)
+	if err != nil {
+		return err
+	}
+	pw, err := NewParquetWriter(parquetFile, columns)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT `+ckanRecordColumns+`
+		FROM cert_store s
+		WHERE ($1::timestamptz IS NULL OR s.discovered >= $1) AND s.discovered < $2
+		ORDER BY s.discovered, s.key`, from, to)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var count int64
+	for rows.Next() {
+		_, rec, err := scanCKANRecord(rows)
+		if err != nil {
+			return err
+		}
+
+		csvRow := make([]string, len(CKANFields))
+		parquetRow := make([]interface{}, len(CKANFields))
+		for i, f := range CKANFields {
+			v := (*rec)[f.ID]
+			csvRow[i] = exportText(v)
+			if columns[i].Kind == ParquetTimestamp {
+				parquetRow[i] = exportTime(v)
+			} else {
+				parquetRow[i] = csvRow[i]
+			}
+		}
+
+		err = cw.Write(csvRow)
+		if err != nil {
+			return err
+		}
+		err = pw.Write(parquetRow)
+		if err != nil {
+			return err
+		}
+		bb, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = jsonFile.Write(append(bb, '\n'))
+		if err != nil {
+			return err
+		}
+
+		count++
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+
+	cw.Flush()
+	err = cw.Error()
+	if err != nil {
+		return err
+	}
+	err = pw.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, ef := range files {
+		err = ed.finish(ef, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifestFile, err := ed.newFile("manifest.json", "json")
+	if err != nil {
+		return err
+	}
+	files = append(files, manifestFile)
+	enc := json.NewEncoder(manifestFile)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(&ExportManifest{
+		Kind:        kind,
+		PeriodStart: from,
+		PeriodEnd:   to,
+		Generated:   time.Now().UTC(),
+		Rows:        count,
+		Fields:      CKANFields,
+		Files:       files[:3],
+	})
+	if err != nil {
+		return err
+	}
+	err = ed.finish(manifestFile, dir)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO dataset_exports (kind, period_start, period_end, rows, location)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, period_end) DO UPDATE SET period_start = EXCLUDED.period_start, rows = EXCLUDED.rows, location = EXCLUDED.location, created = now()`,
+		kind, from, to, count, ed.Store.Location(dir+"/"+manifestFile.Name))
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Exported %d certs to %s", count, ed.Store.Location(dir))
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"log"
+
+	que "github.com/bgentry/que-go"
+	"github.com/govau/cf-common/jobs"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyFlushCKANOutbox = "cron_flush_ckan_outbox"
+
+	// CKANBatchSize is the most records sent in one datastore_upsert
+	CKANBatchSize = 250
+
+	// MaxCKANAttempts is how many times a record that CKAN rejects is tried before it is marked failed
+	MaxCKANAttempts = 5
+)
+
+type ckanOutboxItem struct {
+	key []byte
+	rec *ckanRecord
+}
+
+// FlushCKANOutbox upserts records for the certs in ckan_outbox in batches, removing them once sent.
+// If CKAN rejects a batch, it is split to find the records at fault, which are retried on later
+// runs until they are marked failed. If CKAN is unavailable or rate limiting us, we stop until the next run.
+func (us *UpdateDataGovAU) FlushCKANOutbox(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	// If we don't use data.gov.au, don't let the outbox grow forever
+	if us.APIKey == "" {
+		_, err := tx.Exec("DELETE FROM ckan_outbox")
+		return err
+	}
+
+	resourceID, err := us.resourceID(tx)
+	if err == errCKANResourceUnknown {
+		logger.Println(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT `+ckanRecordColumns+`
+		FROM ckan_outbox o
+		JOIN cert_store s ON s.key = o.key
+		WHERE NOT o.failed
+		ORDER BY o.created
+		LIMIT $1`, CKANBatchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var items []*ckanOutboxItem
+	for rows.Next() {
+		key, rec, err := scanCKANRecord(rows)
+		if err != nil {
+			return err
+		}
+		items = append(items, &ckanOutboxItem{key: key, rec: rec})
+	}
+	rows.Close()
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	sent, stop, err := us.flushCKANItems(logger, tx, resourceID, items)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Sent %d of %d records to CKAN", sent, len(items))
+
+	// If we had a full batch and CKAN is happy, this will commit and try again
+	if !stop && len(items) == CKANBatchSize {
+		return jobs.ErrImmediateReschedule
+	}
+
+	// Returning nil will commit and reschedule via cron
+	return nil
+}
+
+// flushCKANItems upserts the items, splitting the batch in two if CKAN rejects it. It returns how many were
+// sent, and stop if CKAN can't take any more for now.
+func (us *UpdateDataGovAU) flushCKANItems(logger *log.Logger, tx *pgx.Tx, resourceID string, items []*ckanOutboxItem) (int, bool, error) {
+	recs := make([]*ckanRecord, len(items))
+	keys := make([][]byte, len(items))
+	for i, item := range items {
+		recs[i] = item.rec
+		keys[i] = item.key
+	}
+
+	upsertErr := us.InsertRecords(logger, resourceID, recs)
+	if upsertErr == nil {
+		_, err := tx.Exec("DELETE FROM ckan_outbox WHERE key = ANY($1::bytea[])", keys)
+		return len(items), false, err
+	}
+
+	ce, ok := upsertErr.(*ckanError)
+	if !ok || ce.transient() {
+		logger.Printf("CKAN unavailable, will try again later: %s", upsertErr)
+		return 0, true, nil
+	}
+
+	if len(items) == 1 {
+		_, err := tx.Exec(`
+			UPDATE ckan_outbox SET attempts = attempts + 1, failed = attempts + 1 >= $2, last_error = $3
+			WHERE key = $1`, items[0].key, MaxCKANAttempts, upsertErr.Error())
+		return 0, false, err
+	}
+
+	mid := len(items) / 2
+	sent1, stop, err := us.flushCKANItems(logger, tx, resourceID, items[:mid])
+	if err != nil || stop {
+		return sent1, stop, err
+	}
+	sent2, stop, err := us.flushCKANItems(logger, tx, resourceID, items[mid:])
+	return sent1 + sent2, stop, err
+}
@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyFlushDigests = "cron_flush_digests"
+
+	// BurstDigestWindow is how long events are collected for, for channels that have gone over
+	// their rate limit and don't have a digest_window of their own
+	BurstDigestWindow = "15 minutes"
+)
+
+// FlushDigests sends a digest to each channel whose oldest pending digest item is older than its window.
+// It also forgets sends that no longer count towards rate limits.
+func FlushDigests(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	_, err := tx.Exec("DELETE FROM notification_sends WHERE created <= now() - $1::interval", RateLimitPeriod)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT i.channel_id
+		FROM notification_digest_items i
+		JOIN notification_channels c ON c.id = i.channel_id
+		GROUP BY i.channel_id, c.digest_window
+		HAVING MIN(i.created) <= now() - COALESCE(c.digest_window, $1::interval)`, BurstDigestWindow)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var channels []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		channels = append(channels, id)
+	}
+	rows.Close()
+
+	for _, id := range channels {
+		err = flushDigest(qc, logger, tx, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushDigest removes all pending items for the channel, and queues them to be sent as one event for each
+// type of digest, e.g. new certs separately from expiring ones
+func flushDigest(qc *que.Client, logger *log.Logger, tx *pgx.Tx, channelID int64) error {
+	rows, err := tx.Query("DELETE FROM notification_digest_items WHERE channel_id = $1 RETURNING event", channelID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	certs := make(map[string][]*CertInfo)
+	for rows.Next() {
+		var bb []byte
+		err = rows.Scan(&bb)
+		if err != nil {
+			return err
+		}
+		var ev Event
+		err = json.Unmarshal(bb, &ev)
+		if err != nil {
+			return err
+		}
+		digestType, ok := digestTypes[ev.Type]
+		if ok && ev.Cert != nil {
+			certs[digestType] = append(certs[digestType], ev.Cert)
+		}
+	}
+	rows.Close()
+
+	for _, digestType := range []string{EventDigest, EventExpiryDigest} {
+		if len(certs[digestType]) == 0 {
+			continue
+		}
+
+		idParts := []string{strconv.FormatInt(channelID, 10)}
+		for _, c := range certs[digestType] {
+			idParts = append(idParts, c.Key)
+		}
+		digest := newEvent(digestType, idParts...)
+		digest.Certs = certs[digestType]
+
+		err = enqueueNotify(qc, tx, channelID, digest)
+		if err != nil {
+			return err
+		}
+
+		logger.Printf("Queued %s of %d certs for channel %d", digestType, len(digest.Certs), channelID)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"log"
+
+	que "github.com/bgentry/que-go"
+	"github.com/govau/cf-common/jobs"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyFlushOpenSearchOutbox = "cron_flush_opensearch_outbox"
+
+	// OpenSearchBatchSize is the most documents sent in one _bulk request
+	OpenSearchBatchSize = 500
+
+	// MaxOpenSearchAttempts is how many times a document that OpenSearch rejects is tried before it is marked failed
+	MaxOpenSearchAttempts = 5
+)
+
+// FlushOpenSearchOutbox indexes the certs in opensearch_outbox in batches, removing them once indexed.
+// Documents that OpenSearch rejects are retried on later runs until they are marked failed. If OpenSearch
+// is unavailable or overloaded, we stop until the next run.
+func (osc *OpenSearch) FlushOpenSearchOutbox(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	// If we don't use OpenSearch, don't let the outbox grow forever
+	if osc.URL == "" {
+		_, err := tx.Exec("DELETE FROM opensearch_outbox")
+		return err
+	}
+
+	err := osc.ensureIndex(logger)
+	if err != nil {
+		logger.Printf("OpenSearch unavailable, will try again later: %s", err)
+		return nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT `+ckanRecordColumns+`
+		FROM opensearch_outbox o
+		JOIN cert_store s ON s.key = o.key
+		WHERE NOT o.failed
+		ORDER BY o.created
+		LIMIT $1`, OpenSearchBatchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	docs, err := osc.openSearchDocs(tx, rows)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	failed, err := osc.bulkIndex(docs)
+	if err != nil {
+		logger.Printf("OpenSearch unavailable, will try again later: %s", err)
+		return nil
+	}
+
+	var indexed, rejected [][]byte
+	var lastErrors []string
+	stop := false
+	for _, doc := range docs {
+		key, _ := base64.RawURLEncoding.DecodeString(doc.Key)
+		fe, ok := failed[doc.Key]
+		switch {
+		case !ok:
+			indexed = append(indexed, key)
+		case fe.transient():
+			// Left as is, to be sent again next time
+			stop = true
+		default:
+			rejected = append(rejected, key)
+			lastErrors = append(lastErrors, fe.Error)
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM opensearch_outbox WHERE key = ANY($1::bytea[])", indexed)
+	if err != nil {
+		return err
+	}
+	if len(rejected) != 0 {
+		_, err = tx.Exec(`
+			UPDATE opensearch_outbox o SET attempts = o.attempts + 1, failed = o.attempts + 1 >= $3, last_error = r.last_error
+			FROM unnest($1::bytea[], $2::text[]) r (key, last_error)
+			WHERE o.key = r.key`, rejected, lastErrors, MaxOpenSearchAttempts)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("Indexed %d of %d certs in OpenSearch", len(indexed), len(docs))
+
+	// If we had a full batch and OpenSearch is happy, this will commit and try again
+	if !stop && len(docs) == OpenSearchBatchSize {
+		return jobs.ErrImmediateReschedule
+	}
+
+	// Returning nil will commit and reschedule via cron
+	return nil
+}
+
+// Reindex indexes every cert in cert_store, in batches, without going via the outbox. It is run by
+// certwatch -reindex-opensearch, for a new index or after changing the mapping.
+func (osc *OpenSearch) Reindex(pool *pgx.ConnPool, logger *log.Logger) error {
+	err := osc.ensureIndex(logger)
+	if err != nil {
+		return err
+	}
+
+	after := []byte{}
+	var indexed, rejected int
+	for {
+		tx, err := pool.Begin()
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(`
+			SELECT `+ckanRecordColumns+`
+			FROM cert_store s
+			WHERE s.key > $1
+			ORDER BY s.key
+			LIMIT $2`, after, OpenSearchBatchSize)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		docs, err := osc.openSearchDocs(tx, rows)
+		rows.Close()
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		failed, err := osc.bulkIndex(docs)
+		if err != nil {
+			return err
+		}
+		for k, fe := range failed {
+			logger.Printf("Rejected %s: %s", k, fe.Error)
+		}
+		indexed += len(docs) - len(failed)
+		rejected += len(failed)
+
+		after, _ = base64.RawURLEncoding.DecodeString(docs[len(docs)-1].Key)
+		logger.Printf("Indexed %d certs so far, %d rejected", indexed, rejected)
+	}
+
+	logger.Printf("Reindex done: indexed %d certs, %d rejected", indexed, rejected)
+
+	return nil
+}
@@ -2,8 +2,12 @@ package jobs
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,7 +21,6 @@ import (
 	ctjsonclient "github.com/google/certificate-transparency-go/jsonclient"
 	cttls "github.com/google/certificate-transparency-go/tls"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
-	"github.com/govau/cf-common/jobs"
 	"github.com/jackc/pgx"
 )
 
@@ -27,15 +30,16 @@ type GetEntriesConf struct {
 }
 
 const (
-	KeyGetEntries     = "get_entries"
-	KeyUpdateMetadata = "update_metadata"
+	KeyGetEntries = "get_entries"
+
+	// Values for cert_store.entry_type
+	EntryTypeX509    = "x509"
+	EntryTypePrecert = "precert"
 
 	DomainSuffix = ".gov.au"
 	MatchDomain  = "gov.au"
 
 	MaxToRequest = 1024
-
-	MaxToUpdate = 1024
 )
 
 func minInt64(a, b int64) int64 {
@@ -67,13 +71,7 @@ var (
 
 // Extract metadata for cert
 func getFieldsAndValsForCert(leaf *ct.MerkleTreeLeaf) map[string]interface{} {
-	var cert *ctx509.Certificate
-	switch leaf.TimestampedEntry.EntryType {
-	case ct.X509LogEntryType:
-		cert, _ = leaf.X509Certificate()
-	case ct.PrecertLogEntryType:
-		cert, _ = leaf.Precertificate()
-	}
+	cert := leafCertificate(leaf)
 
 	var nvb, nva time.Time
 	var issuer string
@@ -116,72 +114,112 @@ func getFieldsAndValsForCert(leaf *ct.MerkleTreeLeaf) map[string]interface{} {
 		cdn = "NOT RECOGNIZED CDN"
 	}
 
+	var issuerOrg, keyType string
+	if cert != nil {
+		issuerOrg = strings.Join(cert.Issuer.Organization, ", ")
+		keyType = publicKeyType(cert)
+	}
+
+	// A precert's fingerprints are of the precertificate, which is only in the entry's extra data,
+	// so are set by precertFingerprints when the entry is fetched
+	var entryType string
+	var sha256FP, sha1FP interface{}
+	switch leaf.TimestampedEntry.EntryType {
+	case ct.X509LogEntryType:
+		entryType = EntryTypeX509
+		sha256FP, sha1FP = fingerprints(leaf.TimestampedEntry.X509Entry.Data)
+	case ct.PrecertLogEntryType:
+		entryType = EntryTypePrecert
+	}
+
 	return map[string]interface{}{
-		"not_valid_after":  nva,
-		"not_valid_before": nvb,
-		"issuer_cn":        issuer,
-		"jurisdiction":     jurisdiction,
-		"cdn":              cdn,
-		"needs_update":     false,
+		"not_valid_after":    nva,
+		"not_valid_before":   nvb,
+		"issuer_cn":          issuer,
+		"issuer_o":           issuerOrg,
+		"jurisdiction":       jurisdiction,
+		"cdn":                cdn,
+		"entry_type":         entryType,
+		"fingerprint_sha256": sha256FP,
+		"fingerprint_sha1":   sha1FP,
+		"key_type":           keyType,
+		"needs_update":       false,
 	}
 }
 
-func RefreshMetadataForEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
-	processed := 0
-	rows, err := tx.Query("SELECT key, leaf FROM cert_store WHERE needs_update = TRUE LIMIT $1", MaxToUpdate)
+// fingerprints returns the hex SHA-256 and SHA-1 of a DER certificate
+func fingerprints(der []byte) (string, string) {
+	sha256FP := sha256.Sum256(der)
+	sha1FP := sha1.Sum(der)
+	return hex.EncodeToString(sha256FP[:]), hex.EncodeToString(sha1FP[:])
+}
+
+// precertFingerprints returns the fingerprints of the precertificate in a precert entry's extra data,
+// the same as crt.sh and other CT tools show, rather than of the TBSCertificate in the leaf
+func precertFingerprints(extraData []byte) (string, string, error) {
+	var pce ct.PrecertChainEntry
+	_, err := cttls.Unmarshal(extraData, &pce)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	defer rows.Close()
-
-	var updates []string
-	var valvals [][]interface{}
-	for rows.Next() {
-		var key, leafData []byte
-		err = rows.Scan(&key, &leafData)
-		if err != nil {
-			return err
-		}
-
-		var leaf ct.MerkleTreeLeaf
-		_, err := cttls.Unmarshal(leafData, &leaf)
-		if err != nil {
-			return err
-		}
+	sha256FP, sha1FP := fingerprints(pce.PreCertificate.Data)
+	return sha256FP, sha1FP, nil
+}
 
-		var sets []string
-		var vals []interface{}
-		cnt := 1
-		for k, v := range getFieldsAndValsForCert(&leaf) {
-			sets = append(sets, fmt.Sprintf("%s = $%d", k, cnt))
-			vals = append(vals, v)
-			cnt++
-		}
-		vals = append(vals, key)
+// publicKeyType describes the key algorithm and size, e.g. RSA-2048 or ECDSA-P-256
+func publicKeyType(cert *ctx509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + k.Curve.Params().Name
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
 
-		updates = append(updates, fmt.Sprintf("UPDATE cert_store SET %s WHERE key = $%d", strings.Join(sets, ", "), cnt))
-		valvals = append(valvals, vals)
+// newCertInfo describes a newly inserted cert for notifications, using the metadata from getFieldsAndValsForCert.
+// Must be called after the cert has been added to cert_store and cert_index, as it compares against other certs.
+func newCertInfo(tx *pgx.Tx, key []byte, domains []string, certMD map[string]interface{}, entryType ct.LogEntryType, logURL string) (*CertInfo, error) {
+	ci := &CertInfo{
+		Key:          base64.RawURLEncoding.EncodeToString(key),
+		Domains:      domains,
+		Issuer:       certMD["issuer_cn"].(string),
+		Jurisdiction: certMD["jurisdiction"].(string),
+		CDN:          certMD["cdn"].(string),
+		NotBefore:    certMD["not_valid_before"].(time.Time),
+		NotAfter:     certMD["not_valid_after"].(time.Time),
+		Precert:      entryType == ct.PrecertLogEntryType,
+		Log:          logURL,
+	}
 
-		processed++
+	var err error
+	ci.Owners, err = lookupOwners(tx, domains)
+	if err != nil {
+		return nil, err
 	}
-	rows.Close()
 
-	for i := 0; i < processed; i++ {
-		_, err = tx.Exec(updates[i], valvals[i]...)
+	rows, err := tx.Query("SELECT d FROM unnest($1::text[]) d WHERE NOT EXISTS (SELECT 1 FROM cert_index i WHERE i.domain = d AND i.key != $2) ORDER BY d", domains, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d string
+		err = rows.Scan(&d)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		ci.NewDomains = append(ci.NewDomains, d)
 	}
+	rows.Close()
 
-	logger.Printf("Updated %d records", processed)
-
-	// If we got any, try again
-	if processed > 0 {
-		return jobs.ErrImmediateReschedule
+	err = tx.QueryRow("SELECT NOT EXISTS (SELECT 1 FROM cert_store WHERE issuer_cn = $1 AND key != $2)", ci.Issuer, key).Scan(&ci.NewIssuer)
+	if err != nil {
+		return nil, err
 	}
 
-	// Returning nil will commit and reschedule via cron
-	return nil
+	return ci, nil
 }
 
 func GetEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
@@ -243,12 +281,12 @@ func GetEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) er
 		doms := make(map[string]bool)
 
 		if cert != nil {
-			if strings.HasSuffix(cert.Subject.CommonName, DomainSuffix) || cert.Subject.CommonName == MatchDomain {
+			if IsMatchingDomain(cert.Subject.CommonName) {
 				doms[cert.Subject.CommonName] = true
 			}
 
 			for _, name := range cert.DNSNames {
-				if strings.HasSuffix(name, DomainSuffix) || name == MatchDomain {
+				if IsMatchingDomain(name) {
 					doms[name] = true
 				}
 			}
@@ -271,14 +309,20 @@ func GetEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) er
 			fields := []string{"key", "leaf"}
 			ph := []string{"$1", "$2"}
 			vals := []interface{}{kh[:], certToStore}
-			var issuer string
-			for k, v := range getFieldsAndValsForCert(&leaf) {
+			certMD := getFieldsAndValsForCert(&leaf)
+			if leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+				sha256FP, sha1FP, err := precertFingerprints(e.ExtraData)
+				if err != nil {
+					// Not worth holding up the log for, the fingerprints are left empty
+					logger.Printf("Error reading precertificate from extra data: %s", err)
+				} else {
+					certMD["fingerprint_sha256"], certMD["fingerprint_sha1"] = sha256FP, sha1FP
+				}
+			}
+			for k, v := range certMD {
 				fields = append(fields, k)
 				ph = append(ph, fmt.Sprintf("$%d", len(ph)+1))
 				vals = append(vals, v)
-				if k == "issuer_cn" {
-					issuer = v.(string)
-				}
 			}
 
 			rows, err := tx.Query(fmt.Sprintf("INSERT INTO cert_store (%s) VALUES (%s) ON CONFLICT DO NOTHING RETURNING key", strings.Join(fields, ", "), strings.Join(ph, ", ")), vals...)
@@ -288,6 +332,14 @@ func GetEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) er
 			didInsert := rows.Next()
 			rows.Close()
 
+			// Fill in the fingerprints of precerts stored before they were taken from the extra data
+			if !didInsert && certMD["fingerprint_sha256"] != nil {
+				_, err = tx.Exec("UPDATE cert_store SET fingerprint_sha256 = $2, fingerprint_sha1 = $3 WHERE key = $1 AND fingerprint_sha256 IS NULL", kh[:], certMD["fingerprint_sha256"], certMD["fingerprint_sha1"])
+				if err != nil {
+					return err
+				}
+			}
+
 			var domList []string
 			for dom := range doms {
 				_, err = tx.Exec("INSERT INTO cert_index (key, domain) VALUES ($1, $2) ON CONFLICT DO NOTHING", kh[:], dom)
@@ -297,36 +349,61 @@ func GetEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) er
 				domList = append(domList, dom)
 			}
 
-			if didInsert {
-				bb, err := json.Marshal(&UpdateSlackConf{
-					Key:     base64.RawURLEncoding.EncodeToString(kh[:]),
-					Domains: domList,
-					Issuer:  issuer,
-				})
+			// Store every name, not just the matching ones, so we can see who else shares the cert
+			var names certNameBatch
+			names.Add(kh[:], CertNames(cert))
+			err = names.Store(tx)
+			if err != nil {
+				return err
+			}
+
+			logged, err := tx.Exec("INSERT INTO cert_logs (key, log_url) VALUES ($1, $2) ON CONFLICT DO NOTHING", kh[:], md.URL)
+			if err != nil {
+				return err
+			}
+
+			// Sent to CKAN and OpenSearch in batches by FlushCKANOutbox and FlushOpenSearchOutbox, and again if seen in another log
+			if didInsert || logged.RowsAffected() != 0 {
+				_, err = tx.Exec("INSERT INTO ckan_outbox (key) VALUES ($1) ON CONFLICT DO NOTHING", kh[:])
 				if err != nil {
 					return err
 				}
-				err = qc.EnqueueInTx(&que.Job{
-					Type: KeyUpdateSlack,
-					Args: bb,
-				}, tx)
+				_, err = tx.Exec("INSERT INTO opensearch_outbox (key) VALUES ($1) ON CONFLICT DO NOTHING", kh[:])
 				if err != nil {
 					return err
 				}
+			}
 
-				bb, err = json.Marshal(&UpdateDataGovAUConf{
-					Data: certToStore,
-				})
+			if didInsert {
+				ci, err := newCertInfo(tx, kh[:], domList, certMD, leaf.TimestampedEntry.EntryType, md.URL)
+				if err != nil {
+					return err
+				}
+
+				ev := newEvent(EventNewCert, ci.Key)
+				ev.Cert = ci
+				err = enqueueNotifications(qc, tx, ev)
 				if err != nil {
 					return err
 				}
-				err = qc.EnqueueInTx(&que.Job{
-					Type: KeyUpdateDataGovAU,
-					Args: bb,
-				}, tx)
+
+				// The chain is only available now, as we don't store it, so this is the one chance to check it
+				reason, err := checkExpectedIssuers(tx, domList, issuerNames(cert, leaf.TimestampedEntry.EntryType, e.ExtraData))
 				if err != nil {
 					return err
 				}
+				if reason != "" {
+					logger.Printf("Unexpected issuer %s for %s: %s", ci.Issuer, ci.Key, reason)
+					ev := newEvent(EventUnexpectedIssuer, ci.Key)
+					ev.Severity = SeverityHigh
+					ev.Reason = reason
+					ev.Cert = ci
+					err = enqueueNotifications(qc, tx, ev)
+					if err != nil {
+						return err
+					}
+				}
+
 			}
 		}
 
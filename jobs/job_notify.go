@@ -0,0 +1,181 @@
+package jobs
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyNotify = "notify"
+
+	// RateLimitPeriod is the period that notification_channels.rate_limit applies to
+	RateLimitPeriod = "1 hour"
+)
+
+// NotifyConf is stored in the que_jobs table. There is one job per channel, so that a
+// failing channel is retried without sending duplicates to the others.
+type NotifyConf struct {
+	ChannelID int64
+
+	// DeliveryID is the row in notification_deliveries. It is 0 for jobs queued before deliveries were
+	// recorded, which are retried by que instead.
+	DeliveryID int64
+
+	Event *Event
+}
+
+// Notify delivers events to the channels configured in notification_channels, recording the outcome
+// in notification_deliveries. Failed deliveries are retried with back-off up to MaxDeliveryAttempts times.
+type Notify struct {
+	// BaseURL is the certmetrics server that notifications link to
+	BaseURL string
+}
+
+func (n *Notify) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	var conf NotifyConf
+	err := json.Unmarshal(job.Args, &conf)
+	if err != nil {
+		return err
+	}
+
+	// Count this towards the channel's rate over the last hour, and find out if we should
+	// add it to a digest instead of sending it, either because the channel always wants
+	// digests, or because it has gone over its rate limit. Sends are counted by adding rows to
+	// notification_sends rather than updating the channel, so that we don't hold a lock on the
+	// channel while talking to the notifier. Concurrent jobs can't see each other's sends until
+	// they commit, so a burst may go over the limit by up to the number of workers.
+	_, err = tx.Exec("INSERT INTO notification_sends (channel_id) VALUES ($1)", conf.ChannelID)
+	if err != nil {
+		return err
+	}
+	var kind string
+	var config []byte
+	var enabled, digest bool
+	err = tx.QueryRow(`
+		SELECT kind, config, enabled, digest_window IS NOT NULL OR COALESCE(rate_limit < (
+			SELECT COUNT(*) FROM notification_sends s WHERE s.channel_id = c.id AND s.created > now() - $2::interval
+		), FALSE)
+		FROM notification_channels c
+		WHERE id = $1`, conf.ChannelID, RateLimitPeriod).Scan(&kind, &config, &enabled, &digest)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			logger.Printf("Notification channel %d no longer exists, dropping", conf.ChannelID)
+			return nil
+		}
+		return err
+	}
+
+	// If the channel has been disabled since we were queued, drop it
+	if !enabled {
+		return n.recordOutcome(tx, conf, DeliveryDropped, false, 0, nil)
+	}
+
+	if _, ok := digestTypes[conf.Event.Type]; ok && digest {
+		bb, err := json.Marshal(conf.Event)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO notification_digest_items (channel_id, event) VALUES ($1, $2)", conf.ChannelID, bb)
+		if err != nil {
+			return err
+		}
+		return n.recordOutcome(tx, conf, DeliveryDigested, false, 0, nil)
+	}
+
+	notifier, err := NewNotifier(kind, config, n.BaseURL)
+	if err != nil {
+		return err
+	}
+
+	responseCode, err := notifier.Notify(conf.Event)
+	if err != nil {
+		if conf.DeliveryID == 0 {
+			return err
+		}
+
+		// Record the failure, rather than returning it, else it would be rolled back along with this job.
+		// Being rate limited counts as an attempt too, so that we give up on an endpoint that always is.
+		logger.Printf("Notification to channel %d failed: %s", conf.ChannelID, err)
+		attempts, err2 := setDeliveryStatus(tx, conf.DeliveryID, DeliveryRetrying, true, responseCode, err)
+		if err2 != nil {
+			return err2
+		}
+		if attempts >= MaxDeliveryAttempts {
+			_, err2 = setDeliveryStatus(tx, conf.DeliveryID, DeliveryFailed, false, 0, nil)
+			return err2
+		}
+		runAt := time.Now().Add(retryBackoff(attempts))
+		if rae, ok := err.(*RetryAfterError); ok {
+			// Come back when asked to
+			runAt = time.Now().Add(rae.After)
+		}
+		return qc.EnqueueInTx(&que.Job{
+			Type:  KeyNotify,
+			Args:  job.Args,
+			RunAt: runAt,
+		}, tx)
+	}
+
+	err = n.recordOutcome(tx, conf, DeliverySent, true, responseCode, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := notifier.(Pager); ok {
+		return recordIncident(tx, conf.ChannelID, conf.Event)
+	}
+
+	return nil
+}
+
+// recordOutcome updates the delivery, if there is one
+func (n *Notify) recordOutcome(tx *pgx.Tx, conf NotifyConf, status string, attempted bool, responseCode int, sendErr error) error {
+	if conf.DeliveryID == 0 {
+		return nil
+	}
+	_, err := setDeliveryStatus(tx, conf.DeliveryID, status, attempted, responseCode, sendErr)
+	return err
+}
+
+// enqueueNotifications queues a job to send the event to each enabled channel subscribed to it,
+// unless it is a new cert covered by a suppression rule. Findings are never suppressed.
+// SIEM destinations get every event, suppressed or not.
+func enqueueNotifications(qc *que.Client, tx *pgx.Tx, ev *Event) error {
+	err := enqueueSIEMEvents(tx, ev)
+	if err != nil {
+		return err
+	}
+
+	err = enqueueStreamEvent(tx, ev)
+	if err != nil {
+		return err
+	}
+
+	if ev.Type == EventNewCert {
+		suppressed, err := isSuppressed(tx, ev.Cert)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			return nil
+		}
+	}
+
+	channels, err := matchingChannels(tx, ev)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range channels {
+		err = enqueueNotify(qc, tx, id, ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
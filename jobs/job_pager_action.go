@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyPagerAction = "pager_action"
+
+	PagerAcknowledge = "acknowledge"
+	PagerResolve     = "resolve"
+)
+
+// Values for pager_incidents.status
+const (
+	IncidentTriggered    = "triggered"
+	IncidentAcknowledged = "acknowledged"
+	IncidentResolved     = "resolved"
+)
+
+// PagerActionConf is stored in the que_jobs table. Either the incident for an EventID, or all
+// incidents for a cert Key (base64, raw URL encoding), are acknowledged or resolved.
+type PagerActionConf struct {
+	EventID string
+	Key     string
+	Action  string
+}
+
+// PagerAction acknowledges or resolves incidents previously triggered in paging channels,
+// as recorded in pager_incidents
+type PagerAction struct {
+	// BaseURL is the certmetrics server that notifications link to
+	BaseURL string
+}
+
+func (pa *PagerAction) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	var conf PagerActionConf
+	err := json.Unmarshal(job.Args, &conf)
+	if err != nil {
+		return err
+	}
+
+	var newStatus string
+	var from []string
+	switch conf.Action {
+	case PagerAcknowledge:
+		newStatus = IncidentAcknowledged
+		from = []string{IncidentTriggered}
+	case PagerResolve:
+		newStatus = IncidentResolved
+		from = []string{IncidentTriggered, IncidentAcknowledged}
+	default:
+		return fmt.Errorf("unknown pager action: %s", conf.Action)
+	}
+
+	var key []byte
+	if conf.Key != "" {
+		key, err = base64.RawURLEncoding.DecodeString(conf.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	type incident struct {
+		eventID   string
+		channelID int64
+		kind      string
+		config    []byte
+	}
+	rows, err := tx.Query(`
+		SELECT i.event_id, i.channel_id, c.kind, c.config
+		FROM pager_incidents i
+		JOIN notification_channels c ON c.id = i.channel_id
+		WHERE (i.event_id = $1 OR i.key = $2) AND i.status = ANY($3::text[]) AND c.enabled
+		FOR UPDATE OF i`, conf.EventID, key, from)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var incidents []*incident
+	for rows.Next() {
+		var i incident
+		err = rows.Scan(&i.eventID, &i.channelID, &i.kind, &i.config)
+		if err != nil {
+			return err
+		}
+		incidents = append(incidents, &i)
+	}
+	rows.Close()
+
+	for _, i := range incidents {
+		n, err := NewNotifier(i.kind, i.config, pa.BaseURL)
+		if err != nil {
+			return err
+		}
+		pager, ok := n.(Pager)
+		if !ok {
+			continue
+		}
+
+		if conf.Action == PagerAcknowledge {
+			err = pager.Acknowledge(i.eventID)
+		} else {
+			err = pager.Resolve(i.eventID)
+		}
+		if rae, ok := err.(*RetryAfterError); ok {
+			// Come back later, for all of them, as repeating an action is harmless
+			return qc.EnqueueInTx(&que.Job{
+				Type:  KeyPagerAction,
+				Args:  job.Args,
+				RunAt: time.Now().Add(rae.After),
+			}, tx)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE pager_incidents SET status = $1, updated = now() WHERE event_id = $2 AND channel_id = $3", newStatus, i.eventID, i.channelID)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("%s: %d incidents", conf.Action, len(incidents))
+
+	return nil
+}
+
+// recordIncident notes that a paging channel was sent an event, so it can be acknowledged or resolved later
+func recordIncident(tx *pgx.Tx, channelID int64, ev *Event) error {
+	var key []byte
+	if ev.Cert != nil {
+		var err error
+		key, err = base64.RawURLEncoding.DecodeString(ev.Cert.Key)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("INSERT INTO pager_incidents (event_id, channel_id, key, event_type, status) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING", ev.ID, channelID, key, ev.Type, IncidentTriggered)
+	return err
+}
@@ -0,0 +1,199 @@
+package jobs
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/govau/cf-common/jobs"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyPublishStream = "cron_publish_stream"
+
+	// StreamBatchSize is the most events published at once
+	StreamBatchSize = 500
+
+	// MaxStreamAttempts is how many times an event that the broker rejects is tried before it is marked failed
+	MaxStreamAttempts = 10
+)
+
+// PublishStream publishes events from stream_outbox to Kafka or NATS. Events are added to the outbox in the
+// same transaction as the certs they describe, so are only published once that has committed. They are
+// published in order. If the broker is unavailable, the batch is retried with back-off, holding up those
+// behind it. If it rejects the batch, the batch is split to find the events at fault, which are tried
+// MaxStreamAttempts times before being marked failed and skipped.
+type PublishStream struct {
+	// Kind is StreamKafka or StreamNATS. If URL is empty, publishing is disabled.
+	Kind     string
+	URL      string
+	Username string
+	Password string
+
+	// Topic is the Kafka topic. For NATS, events are published to Topic.<event type>.
+	Topic string
+
+	// EventTypes are the types of event to publish, e.g. EventNewCert
+	EventTypes []string
+
+	// BaseURL is the certmetrics server that events link to
+	BaseURL string
+}
+
+func (ps *PublishStream) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	// If we don't publish, don't let the outbox grow forever
+	if ps.URL == "" {
+		_, err := tx.Exec("DELETE FROM stream_outbox")
+		return err
+	}
+
+	_, err := tx.Exec("DELETE FROM stream_outbox WHERE NOT (event_type = ANY($1::text[]))", ps.EventTypes)
+	if err != nil {
+		return err
+	}
+
+	publisher, err := NewStreamPublisher(ps.Kind, ps.URL, ps.Username, ps.Password)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, event, attempts, next_attempt FROM stream_outbox
+		WHERE NOT failed
+		ORDER BY id
+		LIMIT $1`, StreamBatchSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	wn := &WebhookNotifier{BaseURL: ps.BaseURL}
+	var events []*streamOutboxItem
+	var due time.Time
+	for rows.Next() {
+		var id int64
+		var bb []byte
+		var attempts int
+		var nextAttempt time.Time
+		err = rows.Scan(&id, &bb, &attempts, &nextAttempt)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			due = nextAttempt
+		}
+
+		var ev Event
+		err = json.Unmarshal(bb, &ev)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(wn.payload(&ev))
+		if err != nil {
+			return err
+		}
+		m := &streamMessage{
+			Topic: ps.Topic,
+			Key:   ev.ID,
+			ID:    ev.ID,
+			Value: value,
+		}
+		if ev.Cert != nil {
+			m.Key = ev.Cert.Key
+		}
+		if ps.Kind == StreamNATS {
+			m.Topic = ps.Topic + "." + ev.Type
+		}
+
+		events = append(events, &streamOutboxItem{id: id, attempts: attempts, msg: m})
+	}
+	rows.Close()
+
+	// Nothing to do, or waiting to retry the oldest
+	if len(events) == 0 || due.After(time.Now()) {
+		return nil
+	}
+
+	published, stop, err := publishStreamItems(logger, tx, publisher, events)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Published %d of %d events to %s", published, len(events), ps.Kind)
+
+	// If we had a full batch and the broker is available, this will commit and try again
+	if !stop && len(events) == StreamBatchSize {
+		return jobs.ErrImmediateReschedule
+	}
+
+	// Returning nil will commit and reschedule via cron
+	return nil
+}
+
+// streamOutboxItem is an event from stream_outbox, ready to publish
+type streamOutboxItem struct {
+	id       int64
+	attempts int
+	msg      *streamMessage
+}
+
+// publishStreamItems publishes the items, splitting the batch in two if the broker rejects it, so that one bad
+// event doesn't hold up the rest. It returns how many were published, and stop if the broker is unavailable.
+func publishStreamItems(logger *log.Logger, tx *pgx.Tx, publisher StreamPublisher, items []*streamOutboxItem) (int, bool, error) {
+	ids := make([]int64, len(items))
+	msgs := make([]*streamMessage, len(items))
+	attempts := 0
+	for i, item := range items {
+		ids[i] = item.id
+		msgs[i] = item.msg
+		if item.attempts > attempts {
+			attempts = item.attempts
+		}
+	}
+
+	publishErr := publisher.Publish(msgs)
+	if publishErr == nil {
+		_, err := tx.Exec("DELETE FROM stream_outbox WHERE id = ANY($1::bigint[])", ids)
+		return len(items), false, err
+	}
+
+	if _, ok := publishErr.(*StreamRejectedError); !ok {
+		// Wait, holding up newer events too, so that they stay in order
+		logger.Printf("Stream unavailable, will try again later: %s", publishErr)
+		if attempts >= MaxStreamAttempts {
+			attempts = MaxStreamAttempts - 1
+		}
+		_, err := tx.Exec(`
+			UPDATE stream_outbox SET attempts = attempts + 1, next_attempt = $1, last_error = $2
+			WHERE id = ANY($3::bigint[])`, time.Now().Add(retryBackoff(attempts+1)), publishErr.Error(), ids)
+		return 0, true, err
+	}
+
+	if len(items) == 1 {
+		logger.Printf("Stream rejected event %d: %s", items[0].id, publishErr)
+		_, err := tx.Exec(`
+			UPDATE stream_outbox SET attempts = attempts + 1, failed = attempts + 1 >= $2, last_error = $3
+			WHERE id = $1`, items[0].id, MaxStreamAttempts, publishErr.Error())
+		return 0, false, err
+	}
+
+	mid := len(items) / 2
+	published1, stop, err := publishStreamItems(logger, tx, publisher, items[:mid])
+	if err != nil || stop {
+		return published1, stop, err
+	}
+	published2, stop, err := publishStreamItems(logger, tx, publisher, items[mid:])
+	return published1 + published2, stop, err
+}
+
+// enqueueStreamEvent adds the event to the stream outbox, to be published once the transaction commits
+func enqueueStreamEvent(tx *pgx.Tx, ev *Event) error {
+	bb, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO stream_outbox (event_type, event) VALUES ($1, $2::jsonb)", ev.Type, bb)
+	return err
+}
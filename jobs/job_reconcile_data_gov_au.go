@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	que "github.com/bgentry/que-go"
+	"github.com/govau/cf-common/jobs"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeyReconcileDataGovAU = "cron_reconcile_data_gov_au"
+
+	// CKANReconcilePageSize is how many keys are fetched per page
+	CKANReconcilePageSize = 1000
+
+	// CKANReconcilePagesPerRun is how many pages are fetched before committing and rescheduling
+	CKANReconcilePagesPerRun = 20
+)
+
+// ReconcileDataGovAU compares the keys in the CKAN datastore with cert_store, adding any certs missing
+// from CKAN to the outbox. The remote keys are paged into ckan_reconcile_keys over several runs of the
+// job, and the result is recorded in ckan_reconcile_runs once all have been fetched. Pages are fetched
+// with datastore_search_sql by _id, rather than datastore_search by offset, as each offset page costs
+// more than the last. If the CKAN datastore doesn't allow SQL search, it falls back to datastore_search.
+func (us *UpdateDataGovAU) ReconcileDataGovAU(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	// If we don't use data.gov.au, fail fast
+	if us.APIKey == "" {
+		return nil
+	}
+
+	resourceID, err := us.resourceID(tx)
+	if err == errCKANResourceUnknown {
+		logger.Println(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Carry on with the unfinished run, if any
+	var runID, fetched, lastID int64
+	err = tx.QueryRow("SELECT id, fetched, last_id FROM ckan_reconcile_runs WHERE finished IS NULL AND resource_id = $1 ORDER BY id DESC LIMIT 1", resourceID).Scan(&runID, &fetched, &lastID)
+	if err == pgx.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO ckan_reconcile_runs (resource_id) VALUES ($1) RETURNING id, fetched, last_id", resourceID).Scan(&runID, &fetched, &lastID)
+	}
+	if err != nil {
+		return err
+	}
+
+	sqlSearch := true
+	for i := 0; i < CKANReconcilePagesPerRun; i++ {
+		var page struct {
+			Records []struct {
+				ID  int64  `json:"_id"`
+				Key string `json:"key"`
+			} `json:"records"`
+		}
+		if sqlSearch {
+			err = us.ckanAction("datastore_search_sql", map[string]interface{}{
+				"sql": fmt.Sprintf(`SELECT _id, %s FROM %s WHERE _id > %d ORDER BY _id LIMIT %d`,
+					ckanQuoteIdent(CKANPrimaryKey), ckanQuoteIdent(resourceID), lastID, CKANReconcilePageSize),
+			}, &page)
+			if ce, ok := err.(*ckanError); ok && !ce.transient() {
+				// SQL search is turned off, or not allowed for us
+				logger.Printf("CKAN SQL search unavailable, paging with datastore_search instead: %s", err)
+				sqlSearch = false
+			}
+		}
+		if !sqlSearch {
+			// As we page in _id order, the keys we have fetched so far are those before the offset
+			err = us.ckanAction("datastore_search", map[string]interface{}{
+				"resource_id": resourceID,
+				"fields":      []string{"_id", CKANPrimaryKey},
+				"sort":        "_id",
+				"offset":      fetched,
+				"limit":       CKANReconcilePageSize,
+			}, &page)
+		}
+		if err != nil {
+			return err
+		}
+
+		var keys [][]byte
+		for _, r := range page.Records {
+			if r.ID <= lastID {
+				// Seen already, as records before the offset were deleted
+				continue
+			}
+			lastID = r.ID
+
+			// []byte keys are published as standard base64
+			k, err := base64.StdEncoding.DecodeString(r.Key)
+			if err != nil {
+				// Not one of ours, so can only be extra
+				k = []byte(r.Key)
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) != 0 {
+			_, err = tx.Exec("INSERT INTO ckan_reconcile_keys (run_id, key) SELECT $1, unnest($2::bytea[]) ON CONFLICT DO NOTHING", runID, keys)
+			if err != nil {
+				return err
+			}
+		}
+		fetched += int64(len(page.Records))
+
+		if len(page.Records) < CKANReconcilePageSize {
+			return us.finishReconcile(logger, tx, runID, fetched)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE ckan_reconcile_runs SET fetched = $2, last_id = $3 WHERE id = $1", runID, fetched, lastID)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Fetched %d keys from CKAN so far", fetched)
+
+	// More to fetch, so commit and come straight back
+	return jobs.ErrImmediateReschedule
+}
+
+// finishReconcile compares the fetched keys with ours. Certs discovered since the run started, or still
+// in the outbox, are not expected to be in CKAN yet. Those the outbox has given up on are counted as
+// failed rather than missing, as they need looking at rather than sending again.
+func (us *UpdateDataGovAU) finishReconcile(logger *log.Logger, tx *pgx.Tx, runID, fetched int64) error {
+	var local, extra, failed int64
+	err := tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM cert_store s WHERE s.discovered < r.started),
+			(SELECT COUNT(*) FROM ckan_reconcile_keys k WHERE k.run_id = r.id AND NOT EXISTS (SELECT 1 FROM cert_store s WHERE s.key = k.key)),
+			(SELECT COUNT(*) FROM ckan_outbox o JOIN cert_store s ON s.key = o.key WHERE o.failed AND s.discovered < r.started
+				AND NOT EXISTS (SELECT 1 FROM ckan_reconcile_keys k WHERE k.run_id = r.id AND k.key = o.key))
+		FROM ckan_reconcile_runs r WHERE r.id = $1`, runID).Scan(&local, &extra, &failed)
+	if err != nil {
+		return err
+	}
+
+	missing, err := tx.Exec(`
+		INSERT INTO ckan_outbox (key)
+		SELECT s.key FROM cert_store s, ckan_reconcile_runs r
+		WHERE r.id = $1 AND s.discovered < r.started
+		AND NOT EXISTS (SELECT 1 FROM ckan_reconcile_keys k WHERE k.run_id = r.id AND k.key = s.key)
+		AND NOT EXISTS (SELECT 1 FROM ckan_outbox o WHERE o.key = s.key)
+		ON CONFLICT DO NOTHING`, runID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE ckan_reconcile_runs SET fetched = $2, local = $3, missing = $4, extra = $5, failed = $6, finished = now() WHERE id = $1", runID, fetched, local, missing.RowsAffected(), extra, failed)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM ckan_reconcile_keys WHERE run_id = $1", runID)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("CKAN has %d records, we have %d: re-publishing %d missing, %d extra, %d failed", fetched, local, missing.RowsAffected(), extra, failed)
+
+	return nil
+}
+
+// ckanQuoteIdent quotes a table or column name for datastore_search_sql, where tables are named by resource ID
+func ckanQuoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
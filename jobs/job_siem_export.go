@@ -0,0 +1,146 @@
+package jobs
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	que "github.com/bgentry/que-go"
+	"github.com/jackc/pgx"
+)
+
+const (
+	KeySIEMExport = "cron_siem_export"
+
+	// SIEMBatchSize is the most events sent to a destination at once
+	SIEMBatchSize = 500
+
+	// SIEMMaxBatchesPerRun stops one busy destination from holding up the job forever
+	SIEMMaxBatchesPerRun = 20
+)
+
+// SIEMExport sends pending events from siem_events to each enabled destination in batches.
+// Failed batches are retried with back-off.
+type SIEMExport struct {
+	// BaseURL is the certmetrics server that events link to
+	BaseURL string
+}
+
+func (se *SIEMExport) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	type destination struct {
+		id           int64
+		name, kind   string
+		config, flds []byte
+	}
+	rows, err := tx.Query("SELECT id, name, kind, config, fields FROM siem_destinations WHERE enabled")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var destinations []*destination
+	for rows.Next() {
+		var d destination
+		err = rows.Scan(&d.id, &d.name, &d.kind, &d.config, &d.flds)
+		if err != nil {
+			return err
+		}
+		destinations = append(destinations, &d)
+	}
+	rows.Close()
+
+	for _, d := range destinations {
+		exporter, err := NewSIEMExporter(d.kind, d.config, d.flds, se.BaseURL)
+		if err != nil {
+			// Bad config for one shouldn't stop the others
+			logger.Printf("SIEM destination %s: %s", d.name, err)
+			continue
+		}
+
+		for i := 0; i < SIEMMaxBatchesPerRun; i++ {
+			sent, err := se.exportBatch(tx, exporter, d.id)
+			if err != nil {
+				logger.Printf("SIEM destination %s: %s", d.name, err)
+				break
+			}
+			if sent == 0 {
+				break
+			}
+			logger.Printf("Sent %d events to SIEM destination %s", sent, d.name)
+		}
+	}
+
+	return nil
+}
+
+// exportBatch sends the next batch of due events to the destination, deleting them if successful,
+// and otherwise scheduling their next attempt. The error is that of the destination.
+func (se *SIEMExport) exportBatch(tx *pgx.Tx, exporter SIEMExporter, destinationID int64) (int, error) {
+	rows, err := tx.Query(`
+		SELECT id, event, attempts FROM siem_events
+		WHERE destination_id = $1 AND next_attempt <= now()
+		ORDER BY id
+		LIMIT $2`, destinationID, SIEMBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	var events []*Event
+	maxAttempts := 0
+	for rows.Next() {
+		var id int64
+		var bb []byte
+		var attempts int
+		err = rows.Scan(&id, &bb, &attempts)
+		if err != nil {
+			return 0, err
+		}
+		var ev Event
+		err = json.Unmarshal(bb, &ev)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+		events = append(events, &ev)
+		if attempts > maxAttempts {
+			maxAttempts = attempts
+		}
+	}
+	rows.Close()
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	exportErr := exporter.Export(events)
+	if exportErr != nil {
+		wait := retryBackoff(maxAttempts + 1)
+		if rae, ok := exportErr.(*RetryAfterError); ok && rae.After > wait {
+			wait = rae.After
+		}
+		_, err = tx.Exec("UPDATE siem_events SET attempts = attempts + 1, next_attempt = $1, last_error = $2 WHERE id = ANY($3::bigint[])", time.Now().Add(wait), exportErr.Error(), ids)
+		if err != nil {
+			return 0, err
+		}
+		return 0, exportErr
+	}
+
+	_, err = tx.Exec("DELETE FROM siem_events WHERE id = ANY($1::bigint[])", ids)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(events), nil
+}
+
+// enqueueSIEMEvents queues the event for each enabled SIEM destination
+func enqueueSIEMEvents(tx *pgx.Tx, ev *Event) error {
+	bb, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO siem_events (destination_id, event) SELECT id, $1::jsonb FROM siem_destinations WHERE enabled", bb)
+	return err
+}
@@ -1,20 +1,12 @@
 package jobs
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"strings"
 	"time"
 
 	que "github.com/bgentry/que-go"
-	ct "github.com/google/certificate-transparency-go"
-	cttls "github.com/google/certificate-transparency-go/tls"
-	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/govau/cf-common/jobs"
 	"github.com/jackc/pgx"
 )
@@ -22,53 +14,26 @@ import (
 const (
 	KeyUpdateDataGovAU   = "update_data_gov_au"
 	KeyBackfillDataGovAU = "backfill_data_gov_au"
-	MaxToBackfill        = 256
+	MaxToBackfill        = 10000
 )
 
+// BackfillDataGovAU adds certs flagged with needs_ckan_backfill to the outbox, to be sent by FlushCKANOutbox
 func (us *UpdateDataGovAU) BackfillDataGovAU(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
-	processed := 0
-	rows, err := tx.Query("SELECT key, leaf FROM cert_store WHERE needs_ckan_backfill = TRUE LIMIT $1", MaxToBackfill)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var keys [][]byte
-	var ckanRecs []*ckanRecord
-	for rows.Next() {
-		var key, leafData []byte
-		err = rows.Scan(&key, &leafData)
-		if err != nil {
-			return err
-		}
-
-		keys = append(keys, key)
-		r, err := makeGovAURecord(leafData)
-		if err != nil {
-			return err
-		}
-		ckanRecs = append(ckanRecs, r)
-
-		processed++
-	}
-	rows.Close()
-
-	for _, k := range keys {
-		_, err = tx.Exec("UPDATE cert_store SET needs_ckan_backfill = $1 WHERE key = $2", false, k)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = us.InsertRecords(logger, ckanRecs)
+	queued, err := tx.Exec(`
+		WITH flagged AS (
+			UPDATE cert_store SET needs_ckan_backfill = FALSE
+			WHERE key IN (SELECT key FROM cert_store WHERE needs_ckan_backfill = TRUE LIMIT $1)
+			RETURNING key
+		)
+		INSERT INTO ckan_outbox (key) SELECT key FROM flagged ON CONFLICT DO NOTHING`, MaxToBackfill)
 	if err != nil {
 		return err
 	}
 
-	logger.Printf("Updated %d records", processed)
+	logger.Printf("Queued %d records", queued.RowsAffected())
 
 	// If we got any, this will commit and try again
-	if processed > 0 {
+	if queued.RowsAffected() > 0 {
 		return jobs.ErrImmediateReschedule
 	}
 
@@ -76,51 +41,45 @@ func (us *UpdateDataGovAU) BackfillDataGovAU(qc *que.Client, logger *log.Logger,
 	return nil
 }
 
-func makeGovAURecord(b []byte) (*ckanRecord, error) {
-	var leaf ct.MerkleTreeLeaf
-	_, err := cttls.Unmarshal(b, &leaf)
+// ckanRecordColumns selects everything published to CKAN for a cert, from cert_store s. Keep in sync
+// with scanCKANRecord and CKANFields.
+const ckanRecordColumns = `
+	s.key, s.leaf, COALESCE(s.issuer_cn, ''), COALESCE(s.issuer_o, ''),
+	ARRAY(SELECT i.domain FROM cert_index i WHERE i.key = s.key ORDER BY i.domain),
+	s.not_valid_before, s.not_valid_after, COALESCE(s.jurisdiction, ''), COALESCE(s.cdn, ''),
+	COALESCE(s.entry_type, ''), COALESCE(s.fingerprint_sha256, ''), COALESCE(s.fingerprint_sha1, ''),
+	COALESCE(s.key_type, ''), s.discovered,
+	ARRAY(SELECT l.log_url FROM cert_logs l WHERE l.key = s.key ORDER BY l.first_seen)`
+
+// scanCKANRecord builds a CKAN record from the stored metadata, as selected by ckanRecordColumns,
+// so that CKAN and Postgres agree
+func scanCKANRecord(rows *pgx.Rows) ([]byte, *ckanRecord, error) {
+	var key, leaf []byte
+	var issuer, issuerOrg, jurisdiction, cdn, entryType, sha256FP, sha1FP, keyType string
+	var domains, logs []string
+	var nvb, nva *time.Time
+	var discovered time.Time
+	err := rows.Scan(&key, &leaf, &issuer, &issuerOrg, &domains, &nvb, &nva, &jurisdiction, &cdn, &entryType, &sha256FP, &sha1FP, &keyType, &discovered, &logs)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var cert *ctx509.Certificate
-	switch leaf.TimestampedEntry.EntryType {
-	case ct.X509LogEntryType:
-		cert, _ = leaf.X509Certificate()
-	case ct.PrecertLogEntryType:
-		cert, _ = leaf.Precertificate()
-	}
-
-	var nvb, nva time.Time
-	var issuer string
-	var domains []string
-	if cert != nil {
-		nva = cert.NotAfter
-		nvb = cert.NotBefore
-		issuer = cert.Issuer.CommonName
-
-		doms := make(map[string]bool)
-		if strings.HasSuffix(cert.Subject.CommonName, DomainSuffix) || cert.Subject.CommonName == MatchDomain {
-			doms[cert.Subject.CommonName] = true
-		}
-		for _, name := range cert.DNSNames {
-			if strings.HasSuffix(name, DomainSuffix) || name == MatchDomain {
-				doms[name] = true
-			}
-		}
-		for k := range doms {
-			domains = append(domains, k)
-		}
-	}
-	kh := sha256.Sum256(b)
-
-	return &ckanRecord{
-		"key":              kh[:],
-		"issuer_cn":        issuer,
-		"domains":          domains,
-		"not_valid_before": nvb,
-		"not_valid_after":  nva,
-		"raw_data":         b,
+	return key, &ckanRecord{
+		"key":                key,
+		"issuer_cn":          issuer,
+		"issuer_o":           issuerOrg,
+		"domains":            domains,
+		"not_valid_before":   nvb,
+		"not_valid_after":    nva,
+		"jurisdiction":       jurisdiction,
+		"cdn":                cdn,
+		"entry_type":         entryType,
+		"fingerprint_sha256": sha256FP,
+		"fingerprint_sha1":   sha1FP,
+		"key_type":           keyType,
+		"discovered":         discovered,
+		"logs":               logs,
+		"raw_data":           leaf,
 	}, nil
 }
 
@@ -132,6 +91,9 @@ type UpdateDataGovAU struct {
 	BaseURL    string
 	APIKey     string
 	ResourceID string
+
+	// PackageID is where BootstrapDataGovAU creates a resource, if ResourceID is not set
+	PackageID string
 }
 
 type ckanField struct {
@@ -141,69 +103,33 @@ type ckanField struct {
 
 type ckanRecord map[string]interface{}
 
-func (us *UpdateDataGovAU) InsertRecords(logger *log.Logger, recs []*ckanRecord) error {
-	payload, err := json.Marshal(&struct {
-		ResourceID string `json:"resource_id"`
-		//Fields     []ckanField   `json:"fields"`
-		//PrimaryKey string        `json:"primary_key"`
-		Records []*ckanRecord `json:"records"`
-		Method  string        `json:"method"`
+func (us *UpdateDataGovAU) InsertRecords(logger *log.Logger, resourceID string, recs []*ckanRecord) error {
+	err := us.ckanAction("datastore_upsert", &struct {
+		ResourceID string        `json:"resource_id"`
+		Records    []*ckanRecord `json:"records"`
+		Method     string        `json:"method"`
 	}{
-		ResourceID: us.ResourceID,
-		// Fields: []ckanField{
-		// 	{ID: "key", Type: "text"},
-		// 	{ID: "issuer_cn", Type: "text"},
-		// 	{ID: "domains", Type: "text[]"},
-		// 	{ID: "not_valid_before", Type: "timestamp"},
-		// 	{ID: "not_valid_after", Type: "timestamp"},
-		// 	{ID: "raw_data", Type: "text"},
-		// },
-		// PrimaryKey: "key",
-		Records: recs,
-		Method:  "upsert",
-	})
+		ResourceID: resourceID,
+		Records:    recs,
+		Method:     "upsert",
+	}, nil)
 	if err != nil {
+		logger.Printf("Error value returned:\n%s\n", err)
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, us.BaseURL+"/api/3/action/datastore_upsert", bytes.NewReader(payload))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", us.APIKey)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	returnVal, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		logger.Printf("Error value returned:\n%s\n", returnVal)
-		return fmt.Errorf("bad status from data.gov.au: %v (%s)", resp.StatusCode, resp.Status)
-	}
-
 	return nil
 }
 
+// Run handles update_data_gov_au jobs queued before the outbox was added, by adding them to it
 func (us *UpdateDataGovAU) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
-	// If we don't use data.gov.au, fail fast
-	if us.APIKey == "" {
-		return nil
-	}
-
 	var conf UpdateDataGovAUConf
 	err := json.Unmarshal(job.Args, &conf)
 	if err != nil {
 		return err
 	}
 
-	rec, err := makeGovAURecord(conf.Data)
-	if err != nil {
-		return err
-	}
-
-	return us.InsertRecords(logger, []*ckanRecord{rec})
+	kh := sha256.Sum256(conf.Data)
+	_, err = tx.Exec("INSERT INTO ckan_outbox (key) SELECT key FROM cert_store WHERE key = $1 ON CONFLICT DO NOTHING", kh[:])
+	return err
 }
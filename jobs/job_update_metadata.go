@@ -0,0 +1,229 @@
+package jobs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	que "github.com/bgentry/que-go"
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/jackc/pgx"
+)
+
+const (
+	// KeyUpdateMetadata is the singleton job that splits the work up
+	KeyUpdateMetadata = "update_metadata"
+
+	// KeyUpdateMetadataRange refreshes all rows flagged needs_update in a range of keys
+	KeyUpdateMetadataRange = "update_metadata_range"
+
+	// DefaultMetadataShards is how many ranges the key space is split into, unless specified in the job args
+	DefaultMetadataShards = 16
+
+	MaxToUpdate = 1024
+)
+
+// UpdateMetadataConf is stored in the que_jobs table for KeyUpdateMetadata
+type UpdateMetadataConf struct {
+	// Shards is how many range jobs to split the refresh over. Defaults to DefaultMetadataShards.
+	Shards int
+}
+
+// UpdateMetadataRangeConf is stored in the que_jobs table for KeyUpdateMetadataRange
+type UpdateMetadataRangeConf struct {
+	// From is inclusive, To is exclusive. A nil To means the end of the key space.
+	From, To []byte
+}
+
+// metadataColumns are the columns set from getFieldsAndValsForCert, in a stable order with their types,
+// so that they can be used in a VALUES list. Keep in sync with that function. Columns marked Keep are
+// left alone when the refreshed value is NULL, i.e. precert fingerprints that need the extra data.
+var metadataColumns = []struct {
+	Name string
+	Type string
+	Keep bool
+}{
+	{"not_valid_before", "timestamptz", false},
+	{"not_valid_after", "timestamptz", false},
+	{"issuer_cn", "text", false},
+	{"issuer_o", "text", false},
+	{"jurisdiction", "text", false},
+	{"cdn", "text", false},
+	{"entry_type", "text", false},
+	{"fingerprint_sha256", "text", true},
+	{"fingerprint_sha1", "text", true},
+	{"key_type", "text", false},
+	{"needs_update", "boolean", false},
+}
+
+// RefreshMetadataForEntries splits the key space into ranges, and enqueues a job to refresh each,
+// so that many workers can share a large re-index. It does nothing if a refresh is already underway.
+func RefreshMetadataForEntries(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	var conf UpdateMetadataConf
+	err := json.Unmarshal(job.Args, &conf)
+	if err != nil {
+		return err
+	}
+	if conf.Shards <= 0 || conf.Shards > 0x10000 {
+		conf.Shards = DefaultMetadataShards
+	}
+
+	var running int
+	err = tx.QueryRow("SELECT COUNT(*) FROM que_jobs WHERE job_class = $1", KeyUpdateMetadataRange).Scan(&running)
+	if err != nil {
+		return err
+	}
+	if running != 0 {
+		logger.Printf("Metadata refresh already in progress with %d range jobs, skipping", running)
+		return nil
+	}
+
+	var needed bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM cert_store WHERE needs_update = TRUE)").Scan(&needed)
+	if err != nil {
+		return err
+	}
+	if !needed {
+		return nil
+	}
+
+	// Keys are SHA256 hashes, so splitting evenly on the first 2 bytes gives evenly sized ranges
+	for i := 0; i < conf.Shards; i++ {
+		rc := &UpdateMetadataRangeConf{
+			From: keyPrefix(i * 0x10000 / conf.Shards),
+		}
+		if i+1 < conf.Shards {
+			rc.To = keyPrefix((i + 1) * 0x10000 / conf.Shards)
+		}
+		bb, err := json.Marshal(rc)
+		if err != nil {
+			return err
+		}
+		err = qc.EnqueueInTx(&que.Job{
+			Type: KeyUpdateMetadataRange,
+			Args: bb,
+		}, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Printf("Split metadata refresh into %d ranges", conf.Shards)
+
+	return nil
+}
+
+func keyPrefix(n int) []byte {
+	rv := make([]byte, 2)
+	binary.BigEndian.PutUint16(rv, uint16(n))
+	return rv
+}
+
+// RefreshMetadataForRange recalculates metadata for up to MaxToUpdate flagged rows in the range,
+// writing them back in a single UPDATE, then enqueues itself for the rest of the range.
+func RefreshMetadataForRange(qc *que.Client, logger *log.Logger, job *que.Job, tx *pgx.Tx) error {
+	var conf UpdateMetadataRangeConf
+	err := json.Unmarshal(job.Args, &conf)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT key, leaf
+		FROM cert_store
+		WHERE needs_update = TRUE AND key >= $1 AND ($2::bytea IS NULL OR key < $2)
+		ORDER BY key
+		LIMIT $3`, conf.From, conf.To, MaxToUpdate)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var rowsPH []string
+	var vals []interface{}
+	var lastKey []byte
+	var keys [][]byte
+	var certNames certNameBatch
+	for rows.Next() {
+		var key, leafData []byte
+		err = rows.Scan(&key, &leafData)
+		if err != nil {
+			return err
+		}
+
+		var leaf ct.MerkleTreeLeaf
+		_, err := cttls.Unmarshal(leafData, &leaf)
+		if err != nil {
+			return err
+		}
+
+		fields := getFieldsAndValsForCert(&leaf)
+		certNames.Add(key, CertNames(leafCertificate(&leaf)))
+
+		vals = append(vals, key)
+		ph := []string{fmt.Sprintf("$%d::bytea", len(vals))}
+		for _, c := range metadataColumns {
+			vals = append(vals, fields[c.Name])
+			ph = append(ph, fmt.Sprintf("$%d::%s", len(vals), c.Type))
+		}
+		rowsPH = append(rowsPH, "("+strings.Join(ph, ", ")+")")
+
+		lastKey = key
+		keys = append(keys, key)
+	}
+	rows.Close()
+
+	if len(rowsPH) == 0 {
+		logger.Printf("Metadata refresh complete for range %x - %x", conf.From, conf.To)
+		return nil
+	}
+
+	var sets []string
+	cols := []string{"key"}
+	for _, c := range metadataColumns {
+		if c.Keep {
+			sets = append(sets, fmt.Sprintf("%s = COALESCE(v.%s, cert_store.%s)", c.Name, c.Name, c.Name))
+		} else {
+			sets = append(sets, fmt.Sprintf("%s = v.%s", c.Name, c.Name))
+		}
+		cols = append(cols, c.Name)
+	}
+	_, err = tx.Exec(fmt.Sprintf("UPDATE cert_store SET %s FROM (VALUES %s) AS v (%s) WHERE cert_store.key = v.key", strings.Join(sets, ", "), strings.Join(rowsPH, ", "), strings.Join(cols, ", ")), vals...)
+	if err != nil {
+		return err
+	}
+
+	err = certNames.Store(tx)
+	if err != nil {
+		return err
+	}
+
+	// CKAN records and OpenSearch documents are built from this metadata, so need to be sent again
+	_, err = tx.Exec("INSERT INTO ckan_outbox (key) SELECT unnest($1::bytea[]) ON CONFLICT DO NOTHING", keys)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO opensearch_outbox (key) SELECT unnest($1::bytea[]) ON CONFLICT DO NOTHING", keys)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Updated %d records", len(rowsPH))
+
+	// Carry on from where we got to. Rows we've done are no longer flagged, but starting from
+	// the last key saves re-scanning the start of the range.
+	bb, err := json.Marshal(&UpdateMetadataRangeConf{
+		From: lastKey,
+		To:   conf.To,
+	})
+	if err != nil {
+		return err
+	}
+	return qc.EnqueueInTx(&que.Job{
+		Type: KeyUpdateMetadataRange,
+		Args: bb,
+	}, tx)
+}
@@ -1,13 +1,8 @@
 package jobs
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
 	"log"
-	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	que "github.com/bgentry/que-go"
@@ -18,6 +13,8 @@ const (
 	KeyUpdateSlack = "cron_slack"
 )
 
+// UpdateSlackConf is stored in the que_jobs table for KeyUpdateSlack. New certs are now sent via
+// KeyNotify, but this remains so that any jobs queued before the upgrade are still delivered.
 type UpdateSlackConf struct {
 	Key     string
 	Domains []string
@@ -41,43 +38,24 @@ func (us *UpdateSlack) Run(qc *que.Client, logger *log.Logger, job *que.Job, tx
 		return err
 	}
 
-	payload, err := json.Marshal(&struct {
-		Text string `json:"text"`
-	}{
-		Text: fmt.Sprintf("*%s* <%s/cert/%s|View...>\n```%s```\n", conf.Issuer, us.BaseURL, conf.Key, strings.Join(conf.Domains, "\n")),
+	_, err = (&SlackNotifier{
+		BaseURL: us.BaseURL,
+		URL:     us.Hook,
+	}).Notify(&Event{
+		Type: EventNewCert,
+		Cert: &CertInfo{
+			Key:     conf.Key,
+			Domains: conf.Domains,
+			Issuer:  conf.Issuer,
+		},
 	})
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, us.Hook, bytes.NewReader(payload))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	resp.Body.Close()
-
-	switch resp.StatusCode {
-	case http.StatusOK:
-		return nil
-
-	case http.StatusTooManyRequests:
+	if rae, ok := err.(*RetryAfterError); ok {
 		// Come back later
-		ttl, err := strconv.Atoi(resp.Header.Get("Retry-After"))
-		if err != nil {
-			return err
-		}
 		return qc.EnqueueInTx(&que.Job{
 			Type:  KeyUpdateSlack,
 			Args:  job.Args,
-			RunAt: time.Now().Add(time.Duration(ttl) * time.Second),
+			RunAt: time.Now().Add(rae.After),
 		}, tx)
-	default:
-		return fmt.Errorf("bad status from Slack: %v", resp.StatusCode)
 	}
+	return err
 }
@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailNotifier sends the event as a plain text email via SMTP. Authentication is only
+// attempted if a username is set.
+// Config: {"host": "smtp.example.com", "port": 587, "username": "x", "password": "x", "from": "certwatch@example.com", "to": ["soc@example.com"]}
+type EmailNotifier struct {
+	BaseURL  string   `json:"-"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+func (en *EmailNotifier) Notify(ev *Event) (int, error) {
+	if len(en.To) == 0 {
+		return 0, nil
+	}
+
+	port := en.Port
+	if port == 0 {
+		port = 25
+	}
+
+	var auth smtp.Auth
+	if en.Username != "" {
+		auth = smtp.PlainAuth("", en.Username, en.Password, en.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", en.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", " ").Replace(eventTitle(ev)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.Replace(eventText(ev, en.BaseURL), "\n", "\r\n", -1))
+
+	return 0, smtp.SendMail(net.JoinHostPort(en.Host, strconv.Itoa(port)), auth, en.From, en.To, msg.Bytes())
+}
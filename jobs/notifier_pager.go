@@ -0,0 +1,194 @@
+package jobs
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	DefaultOpsgenieURL  = "https://api.opsgenie.com"
+
+	// opsgenieMaxMessage is the limit Opsgenie puts on an alert message
+	opsgenieMaxMessage = 130
+)
+
+// Pager is a Notifier for an incident management service, where incidents triggered by Notify
+// (keyed by the event ID) can later be acknowledged or resolved.
+type Pager interface {
+	Notifier
+	Acknowledge(eventID string) error
+	Resolve(eventID string) error
+}
+
+// pagerSeverity maps our severity to the PagerDuty severities, which Opsgenie priorities are derived from
+func pagerSeverity(ev *Event) string {
+	switch {
+	case ev.Severity == SeverityHigh:
+		return "critical"
+	case ev.Type == EventLapsed:
+		return "error"
+	default:
+		return "warning"
+	}
+}
+
+// pagerDetails are the custom details attached to an incident
+func pagerDetails(ev *Event, baseURL string) map[string]interface{} {
+	rv := map[string]interface{}{
+		"event_type": ev.Type,
+	}
+	if ev.Reason != "" {
+		rv["reason"] = ev.Reason
+	}
+	if ev.Cert != nil {
+		rv["domains"] = strings.Join(ev.Cert.Domains, ", ")
+		rv["issuer"] = ev.Cert.Issuer
+		rv["not_before"] = ev.Cert.NotBefore
+		rv["not_after"] = ev.Cert.NotAfter
+		rv["owners"] = strings.Join(ev.Cert.Owners, ", ")
+		rv["certificate"] = certURL(baseURL, ev.Cert)
+	}
+	if len(ev.Certs) != 0 {
+		rv["certificates"] = len(ev.Certs)
+	}
+	return rv
+}
+
+// PagerDutyNotifier sends to the PagerDuty Events API v2, with the event ID as the dedup key.
+// URL defaults to DefaultPagerDutyURL, and can be pointed elsewhere for testing.
+// Config: {"routing_key": "xxx", "url": "http://localhost:9000/v2/enqueue"}
+type PagerDutyNotifier struct {
+	BaseURL    string `json:"-"`
+	URL        string `json:"url"`
+	RoutingKey string `json:"routing_key"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Class         string                 `json:"class,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+func (pd *PagerDutyNotifier) send(e *pagerDutyEvent) (int, error) {
+	u := pd.URL
+	if u == "" {
+		u = DefaultPagerDutyURL
+	}
+	e.RoutingKey = pd.RoutingKey
+	return postJSON(u, e, nil)
+}
+
+func (pd *PagerDutyNotifier) Notify(ev *Event) (int, error) {
+	e := &pagerDutyEvent{
+		EventAction: "trigger",
+		DedupKey:    ev.ID,
+		Payload: &pagerDutyPayload{
+			Summary:       truncate(eventTitle(ev), 1000),
+			Source:        "certwatch",
+			Severity:      pagerSeverity(ev),
+			Timestamp:     ev.Created.Format("2006-01-02T15:04:05.000-0700"),
+			Class:         ev.Type,
+			CustomDetails: pagerDetails(ev, pd.BaseURL),
+		},
+	}
+	if ev.Cert != nil {
+		e.Links = append(e.Links, pagerDutyLink{Href: certURL(pd.BaseURL, ev.Cert), Text: "View certificate"})
+	}
+	return pd.send(e)
+}
+
+func (pd *PagerDutyNotifier) Acknowledge(eventID string) error {
+	_, err := pd.send(&pagerDutyEvent{EventAction: "acknowledge", DedupKey: eventID})
+	return err
+}
+
+func (pd *PagerDutyNotifier) Resolve(eventID string) error {
+	_, err := pd.send(&pagerDutyEvent{EventAction: "resolve", DedupKey: eventID})
+	return err
+}
+
+// OpsgenieNotifier sends to the Opsgenie Alert API, with the event ID as the alert alias.
+// URL defaults to DefaultOpsgenieURL (use https://api.eu.opsgenie.com for EU accounts, or a local
+// stand-in for testing).
+// Config: {"api_key": "xxx", "url": "https://api.eu.opsgenie.com"}
+type OpsgenieNotifier struct {
+	BaseURL string `json:"-"`
+	URL     string `json:"url"`
+	APIKey  string `json:"api_key"`
+}
+
+type opsgenieAlert struct {
+	Message     string                 `json:"message"`
+	Alias       string                 `json:"alias"`
+	Description string                 `json:"description,omitempty"`
+	Priority    string                 `json:"priority,omitempty"`
+	Source      string                 `json:"source,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+}
+
+type opsgenieAction struct {
+	Source string `json:"source,omitempty"`
+}
+
+func (og *OpsgenieNotifier) post(path string, payload interface{}) (int, error) {
+	u := og.URL
+	if u == "" {
+		u = DefaultOpsgenieURL
+	}
+	return postJSON(strings.TrimSuffix(u, "/")+path, payload, map[string]string{
+		"Authorization": "GenieKey " + og.APIKey,
+	})
+}
+
+func (og *OpsgenieNotifier) Notify(ev *Event) (int, error) {
+	priority := map[string]string{
+		"critical": "P1",
+		"error":    "P2",
+		"warning":  "P3",
+	}[pagerSeverity(ev)]
+
+	// Opsgenie only accepts string values in details
+	details := make(map[string]interface{})
+	for k, v := range pagerDetails(ev, og.BaseURL) {
+		details[k] = fmt.Sprint(v)
+	}
+
+	return og.post("/v2/alerts", &opsgenieAlert{
+		Message:     truncate(eventTitle(ev), opsgenieMaxMessage-3),
+		Alias:       ev.ID,
+		Description: eventText(ev, og.BaseURL),
+		Priority:    priority,
+		Source:      "certwatch",
+		Tags:        []string{"certwatch", ev.Type},
+		Details:     details,
+	})
+}
+
+func (og *OpsgenieNotifier) Acknowledge(eventID string) error {
+	_, err := og.post(fmt.Sprintf("/v2/alerts/%s/acknowledge?identifierType=alias", url.PathEscape(eventID)), &opsgenieAction{Source: "certwatch"})
+	return err
+}
+
+func (og *OpsgenieNotifier) Resolve(eventID string) error {
+	_, err := og.post(fmt.Sprintf("/v2/alerts/%s/close?identifierType=alias", url.PathEscape(eventID)), &opsgenieAction{Source: "certwatch"})
+	return err
+}
@@ -0,0 +1,231 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pagerRequest is a request received by a pagerServer
+type pagerRequest struct {
+	Method  string
+	URI     string
+	Headers http.Header
+	Body    map[string]interface{}
+}
+
+// pagerServer records the requests it receives, responding with status
+func pagerServer(t *testing.T, status int) (*httptest.Server, *[]*pagerRequest) {
+	var reqs []*pagerRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bb, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		pr := &pagerRequest{Method: r.Method, URI: r.URL.RequestURI(), Headers: r.Header}
+		err = json.Unmarshal(bb, &pr.Body)
+		if err != nil {
+			t.Errorf("bad JSON body %q: %s", bb, err)
+		}
+		reqs = append(reqs, pr)
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "5")
+		}
+		w.WriteHeader(status)
+	}))
+	return srv, &reqs
+}
+
+func testPagerEvent() *Event {
+	ev := newEvent(EventUnexpectedIssuer, "key")
+	ev.Created = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ev.Severity = SeverityHigh
+	ev.Reason = "Example CA is not an expected issuer for example.gov.au"
+	ev.Cert = &CertInfo{
+		Key:       "abc",
+		Domains:   []string{"example.gov.au", "www.example.gov.au"},
+		Issuer:    "Example CA",
+		NotBefore: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:  time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC),
+		Owners:    []string{"Example Agency"},
+	}
+	return ev
+}
+
+// pagerFieldGet returns the value at the dotted path in a decoded JSON document, e.g. payload.severity
+func pagerFieldGet(doc map[string]interface{}, path string) interface{} {
+	var v interface{} = doc
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
+
+func checkPagerFields(t *testing.T, doc map[string]interface{}, want map[string]interface{}) {
+	t.Helper()
+	for path, w := range want {
+		if got := pagerFieldGet(doc, path); got != w {
+			t.Errorf("%s = %#v, want %#v", path, got, w)
+		}
+	}
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	srv, reqs := pagerServer(t, http.StatusAccepted)
+	defer srv.Close()
+
+	pd := &PagerDutyNotifier{BaseURL: "https://certmetrics.example", URL: srv.URL + "/v2/enqueue", RoutingKey: "routing"}
+	ev := testPagerEvent()
+
+	status, err := pd.Notify(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusAccepted {
+		t.Errorf("got status %d, want %d", status, http.StatusAccepted)
+	}
+	err = pd.Acknowledge(ev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pd.Resolve(ev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(*reqs))
+	}
+	for _, r := range *reqs {
+		if r.Method != http.MethodPost || r.URI != "/v2/enqueue" {
+			t.Errorf("got %s %s, want POST /v2/enqueue", r.Method, r.URI)
+		}
+		if ct := r.Headers.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	}
+
+	trigger := (*reqs)[0].Body
+	checkPagerFields(t, trigger, map[string]interface{}{
+		"routing_key":                    "routing",
+		"event_action":                   "trigger",
+		"dedup_key":                      ev.ID,
+		"payload.summary":                "[HIGH] Unexpected issuer Example CA for example.gov.au, www.example.gov.au",
+		"payload.source":                 "certwatch",
+		"payload.severity":               "critical",
+		"payload.class":                  EventUnexpectedIssuer,
+		"payload.timestamp":              "2024-05-01T12:00:00.000+0000",
+		"payload.custom_details.domains": "example.gov.au, www.example.gov.au",
+		"payload.custom_details.owners":  "Example Agency",
+		"payload.custom_details.reason":  ev.Reason,
+	})
+	links, _ := trigger["links"].([]interface{})
+	if len(links) != 1 || pagerFieldGet(links[0].(map[string]interface{}), "href") != "https://certmetrics.example/cert/abc" {
+		t.Errorf("links = %#v", trigger["links"])
+	}
+
+	for i, action := range []string{"acknowledge", "resolve"} {
+		body := (*reqs)[i+1].Body
+		checkPagerFields(t, body, map[string]interface{}{
+			"routing_key":  "routing",
+			"event_action": action,
+			"dedup_key":    ev.ID,
+		})
+		if _, ok := body["payload"]; ok {
+			t.Errorf("%s has a payload", action)
+		}
+	}
+}
+
+func TestPagerDutyNotifierErrors(t *testing.T) {
+	srv, _ := pagerServer(t, http.StatusBadRequest)
+	defer srv.Close()
+
+	err := (&PagerDutyNotifier{URL: srv.URL, RoutingKey: "routing"}).Resolve("id")
+	if hse, ok := err.(*HTTPStatusError); !ok || hse.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %#v, want HTTPStatusError 400", err)
+	}
+
+	srv, _ = pagerServer(t, http.StatusTooManyRequests)
+	defer srv.Close()
+
+	_, err = (&PagerDutyNotifier{URL: srv.URL, RoutingKey: "routing"}).Notify(testPagerEvent())
+	if _, ok := err.(*RetryAfterError); !ok {
+		t.Errorf("got %#v, want RetryAfterError", err)
+	}
+}
+
+func TestOpsgenieNotifier(t *testing.T) {
+	srv, reqs := pagerServer(t, http.StatusAccepted)
+	defer srv.Close()
+
+	og := &OpsgenieNotifier{BaseURL: "https://certmetrics.example", URL: srv.URL + "/", APIKey: "key"}
+	ev := testPagerEvent()
+	ev.Cert.Domains = append(ev.Cert.Domains, strings.Repeat("long", 40)+".example.gov.au")
+
+	status, err := og.Notify(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusAccepted {
+		t.Errorf("got status %d, want %d", status, http.StatusAccepted)
+	}
+	err = og.Acknowledge(ev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = og.Resolve(ev.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(*reqs))
+	}
+	for i, uri := range []string{
+		"/v2/alerts",
+		"/v2/alerts/" + ev.ID + "/acknowledge?identifierType=alias",
+		"/v2/alerts/" + ev.ID + "/close?identifierType=alias",
+	} {
+		r := (*reqs)[i]
+		if r.Method != http.MethodPost || r.URI != uri {
+			t.Errorf("got %s %s, want POST %s", r.Method, r.URI, uri)
+		}
+		if auth := r.Headers.Get("Authorization"); auth != "GenieKey key" {
+			t.Errorf("Authorization = %q", auth)
+		}
+	}
+
+	alert := (*reqs)[0].Body
+	checkPagerFields(t, alert, map[string]interface{}{
+		"alias":           ev.ID,
+		"priority":        "P1",
+		"source":          "certwatch",
+		"details.domains": strings.Join(ev.Cert.Domains, ", "),
+		"details.issuer":  "Example CA",
+		"details.reason":  ev.Reason,
+	})
+	if msg, _ := alert["message"].(string); len(msg) > opsgenieMaxMessage || !strings.HasPrefix(msg, "[HIGH] Unexpected issuer Example CA") {
+		t.Errorf("message = %q, want at most %d characters", msg, opsgenieMaxMessage)
+	}
+	if tags, _ := alert["tags"].([]interface{}); len(tags) != 2 || tags[1] != EventUnexpectedIssuer {
+		t.Errorf("tags = %#v", alert["tags"])
+	}
+	for k, v := range alert["details"].(map[string]interface{}) {
+		if _, ok := v.(string); !ok {
+			t.Errorf("details.%s = %#v, want a string", k, v)
+		}
+	}
+
+	for i := 1; i < 3; i++ {
+		checkPagerFields(t, (*reqs)[i].Body, map[string]interface{}{"source": "certwatch"})
+	}
+}
@@ -0,0 +1,200 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// slackMaxText is a little under the 3000 character limit Slack puts on text in a block
+	slackMaxText = 2900
+
+	slackDateFormat = "2 Jan 2006"
+)
+
+// Triage responses, sent as the action_id of the buttons in the SlackTriageBlockID block and recorded
+// in cert_triage by the certmetrics Slack interactivity endpoint. The button value is the cert key.
+const (
+	TriageAcknowledged = "acknowledged"
+	TriageExpected     = "expected"
+	TriageInvestigate  = "investigate"
+
+	SlackTriageBlockID       = "certwatch_triage"
+	SlackTriageStatusBlockID = "certwatch_triage_status"
+)
+
+// SlackNotifier posts to a Slack incoming webhook, using Block Kit for single cert events. Set interactive
+// if the Slack app has interactivity pointed at certmetrics /slack/actions, to add triage buttons.
+// Config: {"url": "https://hooks.slack.com/services/xxx", "interactive": true}
+type SlackNotifier struct {
+	BaseURL     string `json:"-"`
+	URL         string `json:"url"`
+	Interactive bool   `json:"interactive"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackElement struct {
+	Type     string     `json:"type"`
+	Text     *slackText `json:"text,omitempty"`
+	URL      string     `json:"url,omitempty"`
+	Style    string     `json:"style,omitempty"`
+	ActionID string     `json:"action_id,omitempty"`
+	Value    string     `json:"value,omitempty"`
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`
+	BlockID  string        `json:"block_id,omitempty"`
+	Text     *slackText    `json:"text,omitempty"`
+	Fields   []*slackText  `json:"fields,omitempty"`
+	Elements []interface{} `json:"elements,omitempty"`
+}
+
+type slackMessage struct {
+	// Text is used for the notification, and by clients that can't show blocks
+	Text   string        `json:"text"`
+	Blocks []*slackBlock `json:"blocks,omitempty"`
+}
+
+func mrkdwn(s string) *slackText {
+	return &slackText{Type: "mrkdwn", Text: s}
+}
+
+func plainText(s string) *slackText {
+	return &slackText{Type: "plain_text", Text: s}
+}
+
+// slackEscape escapes the characters Slack treats as control sequences
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func (sn *SlackNotifier) Notify(ev *Event) (int, error) {
+	var msg *slackMessage
+	switch ev.Type {
+	case EventNewCert, EventUnexpectedIssuer, EventExpiring, EventLapsed:
+		msg = sn.certMessage(ev)
+	case EventDigest, EventExpiryDigest:
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%s*\n", eventTitle(ev))
+		for _, g := range digestGroups(ev.Certs) {
+			fmt.Fprintf(&b, "\n*%s* - %s: %d\n", g.Owner, g.Issuer, len(g.Certs))
+			for i, c := range g.Certs {
+				if i == MaxDigestCertsPerGroup {
+					fmt.Fprintf(&b, "... and %d more\n", len(g.Certs)-i)
+					break
+				}
+				fmt.Fprintf(&b, "<%s|%s>\n", certURL(sn.BaseURL, c), certLabel(c))
+			}
+		}
+		msg = &slackMessage{Text: b.String()}
+	default:
+		msg = &slackMessage{Text: eventText(ev, sn.BaseURL)}
+	}
+
+	return postJSON(sn.URL, msg, nil)
+}
+
+// certMessage shows the details of a single cert as Block Kit blocks
+func (sn *SlackNotifier) certMessage(ev *Event) *slackMessage {
+	c := ev.Cert
+
+	var heading string
+	switch ev.Type {
+	case EventUnexpectedIssuer:
+		heading = fmt.Sprintf(":rotating_light: Unexpected issuer (%s severity)", ev.Severity)
+	case EventExpiring:
+		heading = ":hourglass: Certificate expiring soon"
+	case EventLapsed:
+		heading = ":warning: Certificate has expired"
+	default:
+		heading = "New certificate"
+	}
+
+	msg := &slackMessage{
+		Text: eventTitle(ev),
+		Blocks: []*slackBlock{
+			{Type: "header", Text: plainText(heading)},
+		},
+	}
+
+	if ev.Reason != "" {
+		msg.Blocks = append(msg.Blocks, &slackBlock{Type: "section", Text: mrkdwn(slackEscape(ev.Reason))})
+	}
+
+	msg.Blocks = append(msg.Blocks, &slackBlock{
+		Type: "section",
+		Text: mrkdwn(fmt.Sprintf("```%s```", truncate(slackEscape(strings.Join(c.Domains, "\n")), slackMaxText))),
+	})
+
+	certType := "Certificate"
+	if c.Precert {
+		certType = "Precertificate"
+	}
+	owner := noOwner
+	if len(c.Owners) != 0 {
+		owner = strings.Join(c.Owners, ", ")
+	}
+	msg.Blocks = append(msg.Blocks, &slackBlock{
+		Type: "section",
+		Fields: []*slackText{
+			mrkdwn("*Issuer*\n" + slackEscape(c.Issuer)),
+			mrkdwn("*Type*\n" + certType),
+			mrkdwn("*Valid from*\n" + c.NotBefore.Format(slackDateFormat)),
+			mrkdwn("*Valid until*\n" + c.NotAfter.Format(slackDateFormat)),
+			mrkdwn("*CDN*\n" + slackEscape(c.CDN)),
+			mrkdwn("*Jurisdiction*\n" + slackEscape(c.Jurisdiction)),
+			mrkdwn("*Owner*\n" + slackEscape(owner)),
+			mrkdwn("*First seen in*\n" + slackEscape(c.Log)),
+		},
+	})
+
+	var news []string
+	if c.NewIssuer {
+		news = append(news, ":new: First certificate we have seen from this issuer")
+	}
+	if len(c.NewDomains) != 0 {
+		news = append(news, ":new: New domains: "+slackEscape(strings.Join(c.NewDomains, ", ")))
+	}
+	if len(news) != 0 {
+		msg.Blocks = append(msg.Blocks, &slackBlock{
+			Type:     "context",
+			Elements: []interface{}{mrkdwn(truncate(strings.Join(news, "\n"), slackMaxText))},
+		})
+	}
+
+	actions := []interface{}{
+		&slackElement{Type: "button", Text: plainText("View certificate"), URL: certURL(sn.BaseURL, c), Style: "primary"},
+	}
+	if len(c.Domains) != 0 {
+		actions = append(actions, &slackElement{Type: "button", Text: plainText("View " + truncate(c.Domains[0], 60)), URL: domainURL(sn.BaseURL, c.Domains[0])})
+	}
+	msg.Blocks = append(msg.Blocks, &slackBlock{Type: "actions", Elements: actions})
+
+	// Without interactivity, the buttons would do nothing
+	if !sn.Interactive {
+		return msg
+	}
+	msg.Blocks = append(msg.Blocks, &slackBlock{
+		Type:    "actions",
+		BlockID: SlackTriageBlockID,
+		Elements: []interface{}{
+			&slackElement{Type: "button", Text: plainText("Acknowledge"), ActionID: TriageAcknowledged, Value: c.Key},
+			&slackElement{Type: "button", Text: plainText("Expected"), ActionID: TriageExpected, Value: c.Key, Style: "primary"},
+			&slackElement{Type: "button", Text: plainText("Investigate"), ActionID: TriageInvestigate, Value: c.Key, Style: "danger"},
+		},
+	})
+
+	return msg
+}
@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TeamsNotifier posts a MessageCard to a Microsoft Teams incoming webhook.
+// Config: {"url": "https://example.webhook.office.com/webhookb2/xxx"}
+type TeamsNotifier struct {
+	BaseURL string `json:"-"`
+	URL     string `json:"url"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsSection struct {
+	Facts []teamsFact `json:"facts,omitempty"`
+	Text  string      `json:"text,omitempty"`
+}
+
+type teamsTarget struct {
+	OS  string `json:"os"`
+	URI string `json:"uri"`
+}
+
+type teamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []teamsTarget `json:"targets"`
+}
+
+type teamsMessageCard struct {
+	Type            string         `json:"@type"`
+	Context         string         `json:"@context"`
+	Summary         string         `json:"summary"`
+	Title           string         `json:"title"`
+	ThemeColor      string         `json:"themeColor,omitempty"`
+	Text            string         `json:"text,omitempty"`
+	Sections        []teamsSection `json:"sections,omitempty"`
+	PotentialAction []teamsAction  `json:"potentialAction,omitempty"`
+}
+
+func (tn *TeamsNotifier) Notify(ev *Event) (int, error) {
+	card := &teamsMessageCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: eventTitle(ev),
+		Title:   eventTitle(ev),
+	}
+
+	switch ev.Type {
+	case EventNewCert, EventUnexpectedIssuer, EventExpiring, EventLapsed:
+		card.Sections = []teamsSection{{
+			Text: ev.Reason,
+			Facts: []teamsFact{
+				{Name: "Issuer", Value: ev.Cert.Issuer},
+				{Name: "Domains", Value: strings.Join(ev.Cert.Domains, "<br>")},
+			},
+		}}
+		if ev.Severity == SeverityHigh {
+			card.ThemeColor = "FF0000"
+		}
+		card.PotentialAction = []teamsAction{{
+			Type:    "OpenUri",
+			Name:    "View certificate",
+			Targets: []teamsTarget{{OS: "default", URI: certURL(tn.BaseURL, ev.Cert)}},
+		}}
+	case EventDigest, EventExpiryDigest:
+		for _, g := range digestGroups(ev.Certs) {
+			var lines []string
+			for i, c := range g.Certs {
+				if i == MaxDigestCertsPerGroup {
+					lines = append(lines, fmt.Sprintf("... and %d more", len(g.Certs)-i))
+					break
+				}
+				lines = append(lines, fmt.Sprintf("[%s](%s)", certLabel(c), certURL(tn.BaseURL, c)))
+			}
+			card.Sections = append(card.Sections, teamsSection{
+				Facts: []teamsFact{
+					{Name: "Owner", Value: g.Owner},
+					{Name: "Issuer", Value: g.Issuer},
+					{Name: "Certificates", Value: fmt.Sprintf("%d", len(g.Certs))},
+				},
+				Text: strings.Join(lines, "<br>"),
+			})
+		}
+	default:
+		card.Text = eventText(ev, tn.BaseURL)
+	}
+
+	return postJSON(tn.URL, card, nil)
+}
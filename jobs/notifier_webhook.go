@@ -0,0 +1,137 @@
+package jobs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const (
+	// WebhookSchemaVersion is incremented whenever a field in the webhook payload is changed or removed.
+	// Adding fields does not change the version, so receivers should ignore fields they don't know.
+	WebhookSchemaVersion = 1
+
+	// Headers sent with each webhook. The signature is the hex HMAC-SHA256 of the timestamp header,
+	// a ".", then the body, keyed with the channel secret, and prefixed with "sha256=".
+	WebhookHeaderEventID   = "X-Certwatch-Event-Id"
+	WebhookHeaderTimestamp = "X-Certwatch-Timestamp"
+	WebhookHeaderSignature = "X-Certwatch-Signature"
+)
+
+// WebhookNotifier posts a versioned JSON document describing the event to any URL, with optional
+// extra headers, e.g. for auth. If a secret is set, the payload is signed.
+// Config: {"url": "https://example.com/hook", "secret": "xxx", "headers": {"Authorization": "Bearer xxx"}}
+type WebhookNotifier struct {
+	BaseURL string            `json:"-"`
+	URL     string            `json:"url"`
+	Secret  string            `json:"secret"`
+	Headers map[string]string `json:"headers"`
+}
+
+type webhookCert struct {
+	Key          string    `json:"key"`
+	URL          string    `json:"url"`
+	Domains      []string  `json:"domains"`
+	Issuer       string    `json:"issuer"`
+	Jurisdiction string    `json:"jurisdiction,omitempty"`
+	CDN          string    `json:"cdn,omitempty"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	Precert      bool      `json:"precert"`
+	Log          string    `json:"log,omitempty"`
+	Owners       []string  `json:"owners"`
+	NewDomains   []string  `json:"new_domains"`
+	NewIssuer    bool      `json:"new_issuer"`
+}
+
+type webhookPayload struct {
+	SchemaVersion int            `json:"schema_version"`
+	ID            string         `json:"id"`
+	Type          string         `json:"type"`
+	Created       time.Time      `json:"created"`
+	Severity      string         `json:"severity,omitempty"`
+	Reason        string         `json:"reason,omitempty"`
+	Certificate   *webhookCert   `json:"certificate,omitempty"`
+	Certificates  []*webhookCert `json:"certificates,omitempty"`
+}
+
+func (wn *WebhookNotifier) webhookCert(c *CertInfo) *webhookCert {
+	rv := &webhookCert{
+		Key:          c.Key,
+		URL:          certURL(wn.BaseURL, c),
+		Domains:      c.Domains,
+		Issuer:       c.Issuer,
+		Jurisdiction: c.Jurisdiction,
+		CDN:          c.CDN,
+		NotBefore:    c.NotBefore,
+		NotAfter:     c.NotAfter,
+		Precert:      c.Precert,
+		Log:          c.Log,
+		Owners:       c.Owners,
+		NewDomains:   c.NewDomains,
+		NewIssuer:    c.NewIssuer,
+	}
+	// Prefer empty lists to nulls, to be kinder to receivers
+	if rv.Domains == nil {
+		rv.Domains = []string{}
+	}
+	if rv.Owners == nil {
+		rv.Owners = []string{}
+	}
+	if rv.NewDomains == nil {
+		rv.NewDomains = []string{}
+	}
+	return rv
+}
+
+// SignWebhook returns the value for WebhookHeaderSignature
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// payload is the versioned document describing the event, also used for stream events
+func (wn *WebhookNotifier) payload(ev *Event) *webhookPayload {
+	payload := &webhookPayload{
+		SchemaVersion: WebhookSchemaVersion,
+		ID:            ev.ID,
+		Type:          ev.Type,
+		Created:       ev.Created,
+		Severity:      ev.Severity,
+		Reason:        ev.Reason,
+	}
+	if ev.Cert != nil {
+		payload.Certificate = wn.webhookCert(ev.Cert)
+	}
+	for _, c := range ev.Certs {
+		payload.Certificates = append(payload.Certificates, wn.webhookCert(c))
+	}
+	return payload
+}
+
+func (wn *WebhookNotifier) Notify(ev *Event) (int, error) {
+	body, err := json.Marshal(wn.payload(ev))
+	if err != nil {
+		return 0, err
+	}
+
+	headers := make(map[string]string)
+	for k, v := range wn.Headers {
+		headers[k] = v
+	}
+	headers[WebhookHeaderEventID] = ev.ID
+	if wn.Secret != "" {
+		// Signed at send time, so that retries get a fresh timestamp
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		headers[WebhookHeaderTimestamp] = ts
+		headers[WebhookHeaderSignature] = SignWebhook(wn.Secret, ts, body)
+	}
+
+	return postBody(wn.URL, body, headers)
+}
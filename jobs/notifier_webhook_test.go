@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// webhookSignatureAnswer was computed independently, with Python's hmac module, for receivers to check against
+const webhookSignatureAnswer = "sha256=78d61735efa4ae194cf94d215509de1dc5ca6ab85941362bbb18f2c63b12b820"
+
+func TestSignWebhook(t *testing.T) {
+	got := SignWebhook("whsec_test", "1714564800", []byte(`{"schema_version":1,"id":"abc"}`))
+	if got != webhookSignatureAnswer {
+		t.Errorf("got %s, want %s", got, webhookSignatureAnswer)
+	}
+
+	// Each part is signed
+	for _, sig := range []string{
+		SignWebhook("whsec_other", "1714564800", []byte(`{"schema_version":1,"id":"abc"}`)),
+		SignWebhook("whsec_test", "1714564801", []byte(`{"schema_version":1,"id":"abc"}`)),
+		SignWebhook("whsec_test", "1714564800", []byte(`{"schema_version":1,"id":"abd"}`)),
+		SignWebhook("whsec_test", "1714564800.", []byte(`{"schema_version":1,"id":"abc"}`)),
+	} {
+		if sig == webhookSignatureAnswer {
+			t.Errorf("got the same signature for different input")
+		}
+	}
+}
+
+func TestWebhookNotifierSignature(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	ev := newEvent(EventNewCert, "key")
+	wn := &WebhookNotifier{URL: srv.URL, Secret: "whsec_test"}
+	_, err := wn.Notify(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A receiver checks the signature of the body as received, with the timestamp header
+	ts := headers.Get(WebhookHeaderTimestamp)
+	if ts == "" {
+		t.Fatal("missing timestamp")
+	}
+	if got, want := headers.Get(WebhookHeaderSignature), SignWebhook("whsec_test", ts, body); got != want {
+		t.Errorf("got signature %s, want %s", got, want)
+	}
+	if got := headers.Get(WebhookHeaderEventID); got != ev.ID {
+		t.Errorf("got event ID %s, want %s", got, ev.ID)
+	}
+
+	// Unsigned without a secret
+	wn.Secret = ""
+	_, err = wn.Notify(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get(WebhookHeaderSignature) != "" || headers.Get(WebhookHeaderTimestamp) != "" {
+		t.Errorf("got signature headers without a secret: %v", headers)
+	}
+}
@@ -0,0 +1,352 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channel kinds, as stored in notification_channels.kind
+const (
+	ChannelSlack   = "slack"
+	ChannelTeams   = "teams"
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+
+	// Paging channels implement Pager, so incidents can be acknowledged and resolved
+	ChannelPagerDuty = "pagerduty"
+	ChannelOpsgenie  = "opsgenie"
+)
+
+// Event types
+const (
+	EventNewCert = "new_cert"
+
+	// EventDigest summarises many new certs in one message
+	EventDigest = "digest"
+
+	// EventUnexpectedIssuer is a cert from an issuer not in the expected_issuers for its domain
+	EventUnexpectedIssuer = "unexpected_issuer"
+
+	// EventExpiring is a domain whose newest cert expires soon, and EventLapsed one whose newest cert
+	// has expired. Only the domain in question is listed in Cert.Domains.
+	EventExpiring = "expiring"
+	EventLapsed   = "lapsed"
+
+	// EventExpiryDigest summarises many expiring and lapsed domains in one message
+	EventExpiryDigest = "expiry_digest"
+)
+
+var (
+	// digestTypes are the events that can be batched into digests, and the type of digest they go in
+	digestTypes = map[string]string{
+		EventNewCert:  EventDigest,
+		EventExpiring: EventExpiryDigest,
+		EventLapsed:   EventExpiryDigest,
+	}
+)
+
+// Severities
+const (
+	SeverityHigh = "high"
+)
+
+const (
+	// MaxDigestCertsPerGroup limits how many certs are listed for each owner and issuer in a digest
+	MaxDigestCertsPerGroup = 20
+
+	noOwner = "(no owner)"
+)
+
+// CertInfo describes a certificate in a notification
+type CertInfo struct {
+	// Key is the base64 (raw URL encoding) of the cert_store key
+	Key          string
+	Domains      []string
+	Issuer       string
+	Jurisdiction string
+	CDN          string
+	NotBefore    time.Time
+	NotAfter     time.Time
+
+	// Precert is true if this is a precertificate, rather than the final certificate
+	Precert bool
+
+	// Log is the CT log we first saw the cert in
+	Log string
+
+	// Owners are from domain_owners, for the longest suffix matching each domain
+	Owners []string
+
+	// NewDomains are the domains we had not seen in any other cert, and NewIssuer
+	// is true if we had not seen a cert from this issuer before
+	NewDomains []string
+	NewIssuer  bool
+}
+
+// Event is something to notify a channel about
+type Event struct {
+	// ID is stable across retries and deliveries to different channels, so receivers can deduplicate
+	ID      string
+	Type    string
+	Created time.Time
+
+	// Severity is set for findings that need attention, e.g. SeverityHigh
+	Severity string
+
+	// Reason explains why a finding was raised
+	Reason string
+
+	// Cert is set for single cert events
+	Cert *CertInfo
+
+	// Certs is set for digests
+	Certs []*CertInfo
+}
+
+// newEvent returns an event with an ID derived from its type and the given parts, which should identify
+// the event uniquely, e.g. the cert key. The same inputs always give the same ID.
+func newEvent(eventType string, idParts ...string) *Event {
+	h := sha256.New()
+	io.WriteString(h, eventType)
+	for _, p := range idParts {
+		io.WriteString(h, "|")
+		io.WriteString(h, p)
+	}
+	return &Event{
+		ID:      hex.EncodeToString(h.Sum(nil)[:16]),
+		Type:    eventType,
+		Created: time.Now(),
+	}
+}
+
+// DigestGroup is the certs in a digest with the same owner and issuer
+type DigestGroup struct {
+	Owner  string
+	Issuer string
+	Certs  []*CertInfo
+}
+
+// digestGroups groups certs by owner and issuer, largest groups first
+func digestGroups(certs []*CertInfo) []*DigestGroup {
+	byKey := make(map[[2]string]*DigestGroup)
+	var rv []*DigestGroup
+	for _, c := range certs {
+		owner := noOwner
+		if len(c.Owners) != 0 {
+			owner = strings.Join(c.Owners, ", ")
+		}
+		k := [2]string{owner, c.Issuer}
+		g, ok := byKey[k]
+		if !ok {
+			g = &DigestGroup{Owner: owner, Issuer: c.Issuer}
+			byKey[k] = g
+			rv = append(rv, g)
+		}
+		g.Certs = append(g.Certs, c)
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		if len(rv[i].Certs) != len(rv[j].Certs) {
+			return len(rv[i].Certs) > len(rv[j].Certs)
+		}
+		if rv[i].Owner != rv[j].Owner {
+			return rv[i].Owner < rv[j].Owner
+		}
+		return rv[i].Issuer < rv[j].Issuer
+	})
+	return rv
+}
+
+// certLabel is a short name for a cert, its first domain and how many others it covers
+func certLabel(c *CertInfo) string {
+	switch len(c.Domains) {
+	case 0:
+		return c.Key
+	case 1:
+		return c.Domains[0]
+	default:
+		return fmt.Sprintf("%s (+%d more)", c.Domains[0], len(c.Domains)-1)
+	}
+}
+
+// Notifier sends events to a notification channel, returning the HTTP status of the response, or 0 if
+// there wasn't one, e.g. for email
+type Notifier interface {
+	Notify(ev *Event) (int, error)
+}
+
+// RetryAfterError is returned by a Notifier when the remote end has asked us to slow down
+type RetryAfterError struct {
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.After)
+}
+
+// DefaultRetryAfter is how long we back off when rate limited without a usable Retry-After header
+const DefaultRetryAfter = time.Minute
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if t.Before(now) {
+			return 0
+		}
+		return t.Sub(now)
+	}
+	return DefaultRetryAfter
+}
+
+// HTTPStatusError is returned by a Notifier when the remote end responds with an error status
+type HTTPStatusError struct {
+	Host       string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("bad status from %s: %v (%s)", e.Host, e.StatusCode, e.Body)
+}
+
+// NewNotifier creates a notifier for a channel from its kind and JSON config.
+// baseURL is the certmetrics server to link to.
+func NewNotifier(kind string, config []byte, baseURL string) (Notifier, error) {
+	var n Notifier
+	switch kind {
+	case ChannelSlack:
+		n = &SlackNotifier{BaseURL: baseURL}
+	case ChannelTeams:
+		n = &TeamsNotifier{BaseURL: baseURL}
+	case ChannelWebhook:
+		n = &WebhookNotifier{BaseURL: baseURL}
+	case ChannelEmail:
+		n = &EmailNotifier{BaseURL: baseURL}
+	case ChannelPagerDuty:
+		n = &PagerDutyNotifier{BaseURL: baseURL}
+	case ChannelOpsgenie:
+		n = &OpsgenieNotifier{BaseURL: baseURL}
+	default:
+		return nil, fmt.Errorf("unknown notification channel kind: %s", kind)
+	}
+
+	err := json.Unmarshal(config, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// certURL is the link to view a cert on the certmetrics server
+func certURL(baseURL string, c *CertInfo) string {
+	return fmt.Sprintf("%s/cert/%s", baseURL, c.Key)
+}
+
+// domainURL is the link to the page for a domain, and its subdomains, on the certmetrics server
+func domainURL(baseURL, domain string) string {
+	return fmt.Sprintf("%s/domain/%s", baseURL, url.PathEscape(strings.TrimPrefix(domain, "*.")))
+}
+
+// eventTitle is a one line summary of the event, for channels that need a title or subject
+func eventTitle(ev *Event) string {
+	switch ev.Type {
+	case EventNewCert:
+		return fmt.Sprintf("New certificate from %s for %s", ev.Cert.Issuer, strings.Join(ev.Cert.Domains, ", "))
+	case EventDigest:
+		return fmt.Sprintf("%d new certificates", len(ev.Certs))
+	case EventExpiryDigest:
+		return fmt.Sprintf("%d domains with certificates expiring or expired and no replacement", len(ev.Certs))
+	case EventUnexpectedIssuer:
+		return fmt.Sprintf("[%s] Unexpected issuer %s for %s", strings.ToUpper(ev.Severity), ev.Cert.Issuer, strings.Join(ev.Cert.Domains, ", "))
+	case EventExpiring:
+		return fmt.Sprintf("Certificate for %s expires on %s", strings.Join(ev.Cert.Domains, ", "), ev.Cert.NotAfter.Format("2 Jan 2006"))
+	case EventLapsed:
+		return fmt.Sprintf("Certificate for %s has expired", strings.Join(ev.Cert.Domains, ", "))
+	default:
+		return ev.Type
+	}
+}
+
+// eventText is a plain text description of the event
+func eventText(ev *Event, baseURL string) string {
+	switch ev.Type {
+	case EventNewCert:
+		return fmt.Sprintf("Issuer: %s\n\nDomains:\n%s\n\n%s\n", ev.Cert.Issuer, strings.Join(ev.Cert.Domains, "\n"), certURL(baseURL, ev.Cert))
+	case EventUnexpectedIssuer, EventExpiring, EventLapsed:
+		return fmt.Sprintf("%s\n\n%s\n\nIssuer: %s\n\nDomains:\n%s\n\n%s\n", eventTitle(ev), ev.Reason, ev.Cert.Issuer, strings.Join(ev.Cert.Domains, "\n"), certURL(baseURL, ev.Cert))
+	case EventDigest, EventExpiryDigest:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s\n", eventTitle(ev))
+		for _, g := range digestGroups(ev.Certs) {
+			fmt.Fprintf(&b, "\n%s - %s: %d\n", g.Owner, g.Issuer, len(g.Certs))
+			for i, c := range g.Certs {
+				if i == MaxDigestCertsPerGroup {
+					fmt.Fprintf(&b, "  ... and %d more\n", len(g.Certs)-i)
+					break
+				}
+				fmt.Fprintf(&b, "  %s %s\n", certLabel(c), certURL(baseURL, c))
+			}
+		}
+		return b.String()
+	default:
+		return ev.Type
+	}
+}
+
+// postJSON sends the payload to the URL, returning the response status, and a RetryAfterError if we are
+// being rate limited
+func postJSON(u string, payload interface{}, headers map[string]string) (int, error) {
+	bb, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return postBody(u, bb, headers)
+}
+
+// postBody sends an already marshalled JSON body to the URL, returning the response status, and a
+// RetryAfterError if we are being rate limited
+func postBody(u string, bb []byte, headers map[string]string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(bb))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, nil
+
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// Come back later
+		return resp.StatusCode, &RetryAfterError{After: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+
+	default:
+		return resp.StatusCode, &HTTPStatusError{Host: req.URL.Host, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+}
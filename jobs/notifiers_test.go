@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewNotifier(t *testing.T) {
+	n, err := NewNotifier(ChannelSlack, []byte(`{"url": "https://hooks.slack.com/services/xxx"}`), "https://certmetrics.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, ok := n.(*SlackNotifier)
+	if !ok || sn.URL != "https://hooks.slack.com/services/xxx" || sn.BaseURL != "https://certmetrics.example" {
+		t.Errorf("got %#v", n)
+	}
+
+	n, err = NewNotifier(ChannelWebhook, []byte(`{"url": "https://example.com/hook", "headers": {"Authorization": "Bearer xxx"}}`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wn, ok := n.(*WebhookNotifier)
+	if !ok || wn.URL != "https://example.com/hook" || wn.Headers["Authorization"] != "Bearer xxx" {
+		t.Errorf("got %#v", n)
+	}
+
+	_, err = NewNotifier("pigeon", []byte(`{}`), "")
+	if err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+	_, err = NewNotifier(ChannelTeams, []byte(`{"url": `), "")
+	if err == nil {
+		t.Error("expected an error for bad config")
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("got method %s, want POST", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer xxx" {
+			t.Errorf("Authorization = %q", auth)
+		}
+		bb, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var body map[string]string
+		err = json.Unmarshal(bb, &body)
+		if err != nil || body["text"] != "hello" {
+			t.Errorf("got body %s", bb)
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "30")
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	post := func(s int) (int, error) {
+		status = s
+		return postJSON(srv.URL, map[string]string{"text": "hello"}, map[string]string{"Authorization": "Bearer xxx"})
+	}
+
+	code, err := post(http.StatusNoContent)
+	if err != nil || code != http.StatusNoContent {
+		t.Errorf("got %d, %v for a 204", code, err)
+	}
+
+	code, err = post(http.StatusTooManyRequests)
+	if rae, ok := err.(*RetryAfterError); !ok || rae.After != 30*time.Second || code != http.StatusTooManyRequests {
+		t.Errorf("got %d, %#v for a 429, want RetryAfterError of 30s", code, err)
+	}
+
+	code, err = post(http.StatusInternalServerError)
+	if err == nil || code != http.StatusInternalServerError {
+		t.Errorf("got %d, %v for a 500", code, err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"0", 0},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 01 May 2024 11:00:00 GMT", 0},
+		{"", DefaultRetryAfter},
+		{"-1", DefaultRetryAfter},
+		{"soon", DefaultRetryAfter},
+	} {
+		got := parseRetryAfter(tc.header, now)
+		if got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tc.header, got, tc.want)
+		}
+	}
+}
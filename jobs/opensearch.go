@@ -0,0 +1,290 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// openSearchMapping is used when creating the index. domains_reversed holds each domain with its labels
+// reversed (au.gov.example.www), and its tree subfield each of its parents (au, au.gov, au.gov.example, ...),
+// so that a whole subtree can be found with a term query.
+const openSearchMapping = `{
+	"settings": {
+		"analysis": {
+			"analyzer": {
+				"domain_tree": {
+					"type": "custom",
+					"tokenizer": "domain_tree"
+				}
+			},
+			"tokenizer": {
+				"domain_tree": {
+					"type": "path_hierarchy",
+					"delimiter": "."
+				}
+			}
+		}
+	},
+	"mappings": {
+		"dynamic": "strict",
+		"properties": {
+			"key":                {"type": "keyword"},
+			"url":                {"type": "keyword", "index": false},
+			"domains":            {"type": "keyword"},
+			"domains_reversed":   {"type": "keyword", "fields": {"tree": {"type": "text", "analyzer": "domain_tree", "search_analyzer": "keyword"}}},
+			"issuer_cn":          {"type": "keyword"},
+			"issuer_o":           {"type": "keyword"},
+			"not_valid_before":   {"type": "date"},
+			"not_valid_after":    {"type": "date"},
+			"discovered":         {"type": "date"},
+			"jurisdiction":       {"type": "keyword"},
+			"cdn":                {"type": "keyword"},
+			"entry_type":         {"type": "keyword"},
+			"key_type":           {"type": "keyword"},
+			"fingerprint_sha256": {"type": "keyword"},
+			"fingerprint_sha1":   {"type": "keyword"},
+			"logs":               {"type": "keyword"},
+			"owners":             {"type": "keyword"},
+			"triage":             {"type": "keyword"},
+			"labels":             {"type": "keyword"}
+		}
+	}
+}`
+
+// OpenSearch indexes certs into an OpenSearch (or Elasticsearch) index. If URL is empty, indexing is disabled.
+type OpenSearch struct {
+	// URL is e.g. https://search.example.gov.au:9200
+	URL      string
+	Index    string
+	Username string
+	Password string
+
+	// BaseURL is the certmetrics server, for links to certs
+	BaseURL string
+
+	// indexReady is set once we know the index exists
+	indexReady bool
+}
+
+// openSearchDoc is the document indexed for a cert
+type openSearchDoc struct {
+	Key               string     `json:"key"`
+	URL               string     `json:"url,omitempty"`
+	Domains           []string   `json:"domains"`
+	DomainsReversed   []string   `json:"domains_reversed"`
+	IssuerCN          string     `json:"issuer_cn"`
+	IssuerO           string     `json:"issuer_o"`
+	NotValidBefore    *time.Time `json:"not_valid_before"`
+	NotValidAfter     *time.Time `json:"not_valid_after"`
+	Discovered        time.Time  `json:"discovered"`
+	Jurisdiction      string     `json:"jurisdiction"`
+	CDN               string     `json:"cdn"`
+	EntryType         string     `json:"entry_type"`
+	KeyType           string     `json:"key_type"`
+	FingerprintSHA256 string     `json:"fingerprint_sha256"`
+	FingerprintSHA1   string     `json:"fingerprint_sha1"`
+	Logs              []string   `json:"logs"`
+	Owners            []string   `json:"owners"`
+	Triage            string     `json:"triage"`
+
+	// Labels are name:value pairs for quick filtering, e.g. jurisdiction:au or owner:dta
+	Labels []string `json:"labels"`
+}
+
+// reverseDomain reverses the labels in a domain, so www.example.gov.au becomes au.gov.example.www
+func reverseDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// openSearchDocs builds documents for certs selected by ckanRecordColumns, so that OpenSearch has the
+// same metadata as CKAN, plus the owners and latest triage response
+func (osc *OpenSearch) openSearchDocs(tx *pgx.Tx, rows *pgx.Rows) ([]*openSearchDoc, error) {
+	var rv []*openSearchDoc
+	for rows.Next() {
+		key, rec, err := scanCKANRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		r := *rec
+		doc := &openSearchDoc{
+			Key:               base64.RawURLEncoding.EncodeToString(key),
+			Domains:           r["domains"].([]string),
+			IssuerCN:          r["issuer_cn"].(string),
+			IssuerO:           r["issuer_o"].(string),
+			NotValidBefore:    r["not_valid_before"].(*time.Time),
+			NotValidAfter:     r["not_valid_after"].(*time.Time),
+			Discovered:        r["discovered"].(time.Time),
+			Jurisdiction:      r["jurisdiction"].(string),
+			CDN:               r["cdn"].(string),
+			EntryType:         r["entry_type"].(string),
+			KeyType:           r["key_type"].(string),
+			FingerprintSHA256: r["fingerprint_sha256"].(string),
+			FingerprintSHA1:   r["fingerprint_sha1"].(string),
+			Logs:              r["logs"].([]string),
+		}
+		if osc.BaseURL != "" {
+			doc.URL = fmt.Sprintf("%s/cert/%s", osc.BaseURL, doc.Key)
+		}
+		for _, d := range doc.Domains {
+			doc.DomainsReversed = append(doc.DomainsReversed, reverseDomain(d))
+		}
+		rv = append(rv, doc)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, doc := range rv {
+		doc.Owners, err = lookupOwners(tx, doc.Domains)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _ := base64.RawURLEncoding.DecodeString(doc.Key)
+		err = tx.QueryRow("SELECT response FROM cert_triage WHERE key = $1 ORDER BY created DESC LIMIT 1", key).Scan(&doc.Triage)
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, err
+		}
+
+		doc.Labels = []string{"entry_type:" + doc.EntryType}
+		if doc.Jurisdiction != "" {
+			doc.Labels = append(doc.Labels, "jurisdiction:"+doc.Jurisdiction)
+		}
+		if doc.CDN != "" {
+			doc.Labels = append(doc.Labels, "cdn:"+doc.CDN)
+		}
+		for _, o := range doc.Owners {
+			doc.Labels = append(doc.Labels, "owner:"+o)
+		}
+		if doc.Triage != "" {
+			doc.Labels = append(doc.Labels, "triage:"+doc.Triage)
+		}
+	}
+
+	return rv, nil
+}
+
+// openSearchRequest makes a request to the cluster, returning the body if the status is 2xx
+func (osc *OpenSearch) openSearchRequest(method, path, contentType string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(osc.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if osc.Username != "" {
+		req.SetBasicAuth(osc.Username, osc.Password)
+	}
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return data, resp.StatusCode, &HTTPStatusError{Host: req.URL.Host, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return data, resp.StatusCode, nil
+}
+
+// ensureIndex creates the index with our mapping, if it doesn't exist
+func (osc *OpenSearch) ensureIndex(logger *log.Logger) error {
+	if osc.indexReady {
+		return nil
+	}
+
+	_, status, err := osc.openSearchRequest(http.MethodHead, "/"+osc.Index, "", nil)
+	if status == http.StatusNotFound {
+		_, _, err = osc.openSearchRequest(http.MethodPut, "/"+osc.Index, "application/json", []byte(openSearchMapping))
+		if err == nil {
+			logger.Printf("Created OpenSearch index %s", osc.Index)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	osc.indexReady = true
+	return nil
+}
+
+// bulkItemError is why OpenSearch did not index a document
+type bulkItemError struct {
+	Status int
+	Error  string
+}
+
+// transient is true if the document may be indexed if sent again later
+func (e *bulkItemError) transient() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// bulkIndex indexes the documents with the _bulk API, returning why each document that was not indexed failed, by key
+func (osc *OpenSearch) bulkIndex(docs []*openSearchDoc) (map[string]*bulkItemError, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, doc := range docs {
+		err := enc.Encode(map[string]interface{}{
+			"index": map[string]string{"_index": osc.Index, "_id": doc.Key},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Encode(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, _, err := osc.openSearchRequest(http.MethodPost, "/_bulk", "application/x-ndjson", b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]*bulkItemError)
+	if !result.Errors {
+		return failed, nil
+	}
+	for _, item := range result.Items {
+		for _, r := range item {
+			if r.Status/100 != 2 {
+				failed[r.ID] = &bulkItemError{Status: r.Status, Error: string(r.Error)}
+			}
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,368 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// A minimal Parquet writer, enough for flat files of strings and timestamps: PLAIN encoding, no
+// compression, one page per column per row group. See https://github.com/apache/parquet-format
+
+const (
+	parquetMagic = "PAR1"
+
+	// ParquetRowGroupSize is how many rows are buffered before being written as a row group
+	ParquetRowGroupSize = 50000
+)
+
+// Parquet column kinds
+const (
+	// ParquetString is a required UTF8 BYTE_ARRAY
+	ParquetString = iota
+
+	// ParquetTimestamp is an optional INT64 TIMESTAMP_MILLIS, nil for null
+	ParquetTimestamp
+)
+
+// Thrift enum values from parquet.thrift
+const (
+	parquetTypeInt64     = 2
+	parquetTypeByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMillis = 9
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	parquetCodecUncompressed = 0
+	parquetPageData          = 0
+)
+
+// ParquetColumn describes a column
+type ParquetColumn struct {
+	Name string
+	Kind int
+}
+
+type parquetColumnChunk struct {
+	offset, size int64
+	numValues    int64
+}
+
+// ParquetWriter writes rows to a Parquet file. Values are string for ParquetString columns, and
+// *time.Time for ParquetTimestamp. Close must be called to write the footer.
+type ParquetWriter struct {
+	w       io.Writer
+	pos     int64
+	columns []ParquetColumn
+
+	// rows buffered for the current row group, by column
+	buffered [][]interface{}
+	numRows  int
+
+	rowGroups [][]parquetColumnChunk
+	rgRows    []int64
+	totalRows int64
+}
+
+// NewParquetWriter writes the header and returns a writer
+func NewParquetWriter(w io.Writer, columns []ParquetColumn) (*ParquetWriter, error) {
+	pw := &ParquetWriter{
+		w:        w,
+		columns:  columns,
+		buffered: make([][]interface{}, len(columns)),
+	}
+	err := pw.write([]byte(parquetMagic))
+	if err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *ParquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.pos += int64(n)
+	return err
+}
+
+// Write adds a row, with a value for each column
+func (pw *ParquetWriter) Write(row []interface{}) error {
+	for i, v := range row {
+		pw.buffered[i] = append(pw.buffered[i], v)
+	}
+	pw.numRows++
+	if pw.numRows >= ParquetRowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// rleRuns encodes bit width 1 definition levels with the RLE/bit-packing hybrid, using only RLE runs
+func rleRuns(levels []byte) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		writeUvarint(&b, uint64(j-i)<<1)
+		b.WriteByte(levels[i])
+		i = j
+	}
+	return b.Bytes()
+}
+
+func (pw *ParquetWriter) flushRowGroup() error {
+	if pw.numRows == 0 {
+		return nil
+	}
+
+	var chunks []parquetColumnChunk
+	for i, col := range pw.columns {
+		var data bytes.Buffer
+		switch col.Kind {
+		case ParquetString:
+			for _, v := range pw.buffered[i] {
+				s := v.(string)
+				binary.Write(&data, binary.LittleEndian, uint32(len(s)))
+				data.WriteString(s)
+			}
+		case ParquetTimestamp:
+			var levels []byte
+			var values bytes.Buffer
+			for _, v := range pw.buffered[i] {
+				t, _ := v.(*time.Time)
+				if t == nil {
+					levels = append(levels, 0)
+					continue
+				}
+				levels = append(levels, 1)
+				binary.Write(&values, binary.LittleEndian, t.Unix()*1000+int64(t.Nanosecond()/1e6))
+			}
+			rle := rleRuns(levels)
+			binary.Write(&data, binary.LittleEndian, uint32(len(rle)))
+			data.Write(rle)
+			data.Write(values.Bytes())
+		}
+
+		var header bytes.Buffer
+		tw := &thriftCompactWriter{w: &header}
+		tw.fieldI32(1, parquetPageData)
+		tw.fieldI32(2, int32(data.Len()))
+		tw.fieldI32(3, int32(data.Len()))
+		tw.fieldStructBegin(5)
+		tw.fieldI32(1, int32(pw.numRows))
+		tw.fieldI32(2, parquetEncodingPlain)
+		tw.fieldI32(3, parquetEncodingRLE)
+		tw.fieldI32(4, parquetEncodingRLE)
+		tw.structEnd()
+		tw.structEnd()
+
+		chunk := parquetColumnChunk{
+			offset:    pw.pos,
+			size:      int64(header.Len() + data.Len()),
+			numValues: int64(pw.numRows),
+		}
+		err := pw.write(header.Bytes())
+		if err != nil {
+			return err
+		}
+		err = pw.write(data.Bytes())
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		pw.buffered[i] = pw.buffered[i][:0]
+	}
+
+	pw.rowGroups = append(pw.rowGroups, chunks)
+	pw.rgRows = append(pw.rgRows, int64(pw.numRows))
+	pw.totalRows += int64(pw.numRows)
+	pw.numRows = 0
+
+	return nil
+}
+
+// Close writes any buffered rows and the footer. It does not close the underlying writer.
+func (pw *ParquetWriter) Close() error {
+	err := pw.flushRowGroup()
+	if err != nil {
+		return err
+	}
+
+	var meta bytes.Buffer
+	tw := &thriftCompactWriter{w: &meta}
+	tw.fieldI32(1, 1)
+
+	// Schema is a flattened tree, with the root first
+	tw.fieldListBegin(2, thriftStruct, len(pw.columns)+1)
+	tw.structBegin()
+	tw.fieldString(4, "schema")
+	tw.fieldI32(5, int32(len(pw.columns)))
+	tw.structEnd()
+	for _, col := range pw.columns {
+		tw.structBegin()
+		switch col.Kind {
+		case ParquetString:
+			tw.fieldI32(1, parquetTypeByteArray)
+			tw.fieldI32(3, parquetRequired)
+			tw.fieldString(4, col.Name)
+			tw.fieldI32(6, parquetConvertedUTF8)
+		case ParquetTimestamp:
+			tw.fieldI32(1, parquetTypeInt64)
+			tw.fieldI32(3, parquetOptional)
+			tw.fieldString(4, col.Name)
+			tw.fieldI32(6, parquetConvertedTimestampMillis)
+		}
+		tw.structEnd()
+	}
+
+	tw.fieldI64(3, pw.totalRows)
+
+	tw.fieldListBegin(4, thriftStruct, len(pw.rowGroups))
+	for rg, chunks := range pw.rowGroups {
+		tw.structBegin()
+		tw.fieldListBegin(1, thriftStruct, len(chunks))
+		var total int64
+		for i, c := range chunks {
+			col := pw.columns[i]
+			physical := int32(parquetTypeByteArray)
+			if col.Kind == ParquetTimestamp {
+				physical = parquetTypeInt64
+			}
+			tw.structBegin()
+			tw.fieldI64(2, c.offset)
+			tw.fieldStructBegin(3)
+			tw.fieldI32(1, physical)
+			tw.fieldListBegin(2, thriftI32, 2)
+			tw.i32(parquetEncodingPlain)
+			tw.i32(parquetEncodingRLE)
+			tw.fieldListBegin(3, thriftBinary, 1)
+			tw.binary(col.Name)
+			tw.fieldI32(4, parquetCodecUncompressed)
+			tw.fieldI64(5, c.numValues)
+			tw.fieldI64(6, c.size)
+			tw.fieldI64(7, c.size)
+			tw.fieldI64(9, c.offset)
+			tw.structEnd()
+			tw.structEnd()
+			total += c.size
+		}
+		tw.fieldI64(2, total)
+		tw.fieldI64(3, pw.rgRows[rg])
+		tw.structEnd()
+	}
+
+	tw.fieldString(6, "certwatch")
+	tw.structEnd()
+
+	err = pw.write(meta.Bytes())
+	if err != nil {
+		return err
+	}
+	var footer [4]byte
+	binary.LittleEndian.PutUint32(footer[:], uint32(meta.Len()))
+	err = pw.write(footer[:])
+	if err != nil {
+		return err
+	}
+	return pw.write([]byte(parquetMagic))
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompactWriter writes just enough of the Thrift compact protocol for Parquet metadata
+type thriftCompactWriter struct {
+	w       *bytes.Buffer
+	lastID  int16
+	idStack []int16
+}
+
+func writeUvarint(w *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.Write(buf[:n])
+}
+
+func (tw *thriftCompactWriter) fieldHeader(id int16, typ byte) {
+	delta := id - tw.lastID
+	if delta > 0 && delta <= 15 {
+		tw.w.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		tw.w.WriteByte(typ)
+		writeUvarint(tw.w, uint64((int64(id)<<1)^(int64(id)>>63)))
+	}
+	tw.lastID = id
+}
+
+func (tw *thriftCompactWriter) i32(v int32) {
+	writeUvarint(tw.w, uint64(uint32((v<<1)^(v>>31))))
+}
+
+func (tw *thriftCompactWriter) i64(v int64) {
+	writeUvarint(tw.w, uint64((v<<1)^(v>>63)))
+}
+
+func (tw *thriftCompactWriter) binary(s string) {
+	writeUvarint(tw.w, uint64(len(s)))
+	tw.w.WriteString(s)
+}
+
+func (tw *thriftCompactWriter) fieldI32(id int16, v int32) {
+	tw.fieldHeader(id, thriftI32)
+	tw.i32(v)
+}
+
+func (tw *thriftCompactWriter) fieldI64(id int16, v int64) {
+	tw.fieldHeader(id, thriftI64)
+	tw.i64(v)
+}
+
+func (tw *thriftCompactWriter) fieldString(id int16, s string) {
+	tw.fieldHeader(id, thriftBinary)
+	tw.binary(s)
+}
+
+func (tw *thriftCompactWriter) fieldListBegin(id int16, elemType byte, size int) {
+	tw.fieldHeader(id, thriftList)
+	if size < 15 {
+		tw.w.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		tw.w.WriteByte(0xf0 | elemType)
+		writeUvarint(tw.w, uint64(size))
+	}
+}
+
+// structBegin starts a struct that is a list element
+func (tw *thriftCompactWriter) structBegin() {
+	tw.idStack = append(tw.idStack, tw.lastID)
+	tw.lastID = 0
+}
+
+// fieldStructBegin starts a struct that is a field
+func (tw *thriftCompactWriter) fieldStructBegin(id int16) {
+	tw.fieldHeader(id, thriftStruct)
+	tw.structBegin()
+}
+
+// structEnd ends a struct. The outermost struct is ended without a matching begin.
+func (tw *thriftCompactWriter) structEnd() {
+	tw.w.WriteByte(0)
+	if len(tw.idStack) != 0 {
+		tw.lastID = tw.idStack[len(tw.idStack)-1]
+		tw.idStack = tw.idStack[:len(tw.idStack)-1]
+	}
+}
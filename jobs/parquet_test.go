@@ -0,0 +1,376 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// The file is read back with a reader written from the Parquet and Thrift specs, rather than from
+// ParquetWriter, to check that other readers will understand it
+
+// thriftStructValue is a decoded Thrift struct, by field ID
+type thriftStructValue map[int16]interface{}
+
+// thriftCompactReader reads any value in the Thrift compact protocol
+type thriftCompactReader struct {
+	r *bufio.Reader
+}
+
+func (tr *thriftCompactReader) varint() (int64, error) {
+	u, err := binary.ReadUvarint(tr.r)
+	return int64(u>>1) ^ -int64(u&1), err
+}
+
+func (tr *thriftCompactReader) value(typ byte) (interface{}, error) {
+	switch typ {
+	case 1, 2: // bool true, false
+		return typ == 1, nil
+	case 3: // byte
+		return tr.r.ReadByte()
+	case 4, 5, 6: // i16, i32, i64
+		return tr.varint()
+	case 7: // double
+		var v uint64
+		err := binary.Read(tr.r, binary.LittleEndian, &v)
+		return math.Float64frombits(v), err
+	case 8: // binary
+		n, err := binary.ReadUvarint(tr.r)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(tr.r, b)
+		return string(b), err
+	case 9: // list
+		h, err := tr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := int(h >> 4)
+		if size == 15 {
+			n, err := binary.ReadUvarint(tr.r)
+			if err != nil {
+				return nil, err
+			}
+			size = int(n)
+		}
+		var rv []interface{}
+		for i := 0; i < size; i++ {
+			elemType := h & 0x0f
+			if elemType == 1 || elemType == 2 {
+				// bools in lists are a byte each
+				b, err := tr.r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				rv = append(rv, b == 1)
+				continue
+			}
+			v, err := tr.value(elemType)
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, v)
+		}
+		return rv, nil
+	case 12: // struct
+		rv := make(thriftStructValue)
+		var lastID int16
+		for {
+			h, err := tr.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if h == 0 {
+				return rv, nil
+			}
+			id := lastID + int16(h>>4)
+			if h>>4 == 0 {
+				v, err := tr.varint()
+				if err != nil {
+					return nil, err
+				}
+				id = int16(v)
+			}
+			v, err := tr.value(h & 0x0f)
+			if err != nil {
+				return nil, err
+			}
+			rv[id] = v
+			lastID = id
+		}
+	default:
+		return nil, fmt.Errorf("unsupported thrift type %d", typ)
+	}
+}
+
+// readThriftStruct reads a struct from the start of b, returning it and its length
+func readThriftStruct(b []byte) (thriftStructValue, int, error) {
+	br := bytes.NewReader(b)
+	tr := &thriftCompactReader{r: bufio.NewReaderSize(br, 16)}
+	v, err := tr.value(12)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v.(thriftStructValue), len(b) - br.Len() - tr.r.Buffered(), nil
+}
+
+func (s thriftStructValue) i64(id int16) int64 {
+	v, _ := s[id].(int64)
+	return v
+}
+
+func (s thriftStructValue) str(id int16) string {
+	v, _ := s[id].(string)
+	return v
+}
+
+func (s thriftStructValue) list(id int16) []interface{} {
+	v, _ := s[id].([]interface{})
+	return v
+}
+
+func (s thriftStructValue) child(id int16) thriftStructValue {
+	v, _ := s[id].(thriftStructValue)
+	return v
+}
+
+// readParquetColumn decodes the PLAIN values of a column chunk with a single data page, returning nil for
+// nulls in optional columns
+func readParquetColumn(file []byte, chunk thriftStructValue, physical int64, optional bool) ([]interface{}, error) {
+	meta := chunk.child(3)
+	offset := meta.i64(9)
+	header, n, err := readThriftStruct(file[offset:])
+	if err != nil {
+		return nil, err
+	}
+	if header.i64(1) != 0 {
+		return nil, fmt.Errorf("page type %d, want a data page", header.i64(1))
+	}
+	dph := header.child(5)
+	if dph.i64(2) != 0 {
+		return nil, fmt.Errorf("encoding %d, want PLAIN", dph.i64(2))
+	}
+	numValues := int(dph.i64(1))
+	data := file[offset+int64(n) : offset+int64(n)+header.i64(3)]
+
+	// Definition levels, with the RLE/bit-packing hybrid at bit width 1
+	defined := make([]bool, numValues)
+	for i := range defined {
+		defined[i] = true
+	}
+	if optional {
+		size := binary.LittleEndian.Uint32(data)
+		levels := bytes.NewReader(data[4 : 4+size])
+		data = data[4+size:]
+		i := 0
+		for levels.Len() > 0 {
+			h, err := binary.ReadUvarint(levels)
+			if err != nil {
+				return nil, err
+			}
+			if h&1 == 1 {
+				// bit-packed groups of 8
+				for g := 0; g < int(h>>1); g++ {
+					b, err := levels.ReadByte()
+					if err != nil {
+						return nil, err
+					}
+					for bit := uint(0); bit < 8 && i < numValues; bit++ {
+						defined[i] = b>>bit&1 == 1
+						i++
+					}
+				}
+				continue
+			}
+			b, err := levels.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			for run := 0; run < int(h>>1); run++ {
+				defined[i] = b == 1
+				i++
+			}
+		}
+		if i < numValues {
+			return nil, fmt.Errorf("got %d definition levels, want %d", i, numValues)
+		}
+	}
+
+	var rv []interface{}
+	for _, d := range defined {
+		if !d {
+			rv = append(rv, nil)
+			continue
+		}
+		switch physical {
+		case parquetTypeInt64:
+			rv = append(rv, int64(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case parquetTypeByteArray:
+			size := binary.LittleEndian.Uint32(data)
+			rv = append(rv, string(data[4:4+size]))
+			data = data[4+size:]
+		}
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%d bytes left over", len(data))
+	}
+	return rv, nil
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []ParquetColumn{
+		{Name: "key", Kind: ParquetString},
+		{Name: "not_valid_after", Kind: ParquetTimestamp},
+		{Name: "issuer_cn", Kind: ParquetString},
+	}
+
+	times := []*time.Time{
+		nil,
+		timePtr(time.Date(2024, 5, 1, 12, 30, 45, 123456789, time.UTC)),
+		timePtr(time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC)),
+		// After UnixNano overflows
+		timePtr(time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	issuers := []string{"", "Let's Encrypt", "Ünïcödé CA"}
+
+	// Enough rows for two row groups
+	numRows := ParquetRowGroupSize + 10
+	var want [][]interface{}
+	for i := 0; i < numRows; i++ {
+		want = append(want, []interface{}{fmt.Sprintf("key-%d", i), times[i%len(times)], issuers[i%len(issuers)]})
+	}
+
+	var b bytes.Buffer
+	pw, err := NewParquetWriter(&b, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range want {
+		err = pw.Write(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = pw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := b.Bytes()
+	if string(file[:4]) != "PAR1" || string(file[len(file)-4:]) != "PAR1" {
+		t.Fatal("missing PAR1 magic")
+	}
+	metaLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	meta, n, err := readThriftStruct(file[len(file)-8-metaLen : len(file)-8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != metaLen {
+		t.Errorf("read %d bytes of file metadata, want %d", n, metaLen)
+	}
+	if meta.i64(3) != int64(numRows) {
+		t.Errorf("got %d rows, want %d", meta.i64(3), numRows)
+	}
+
+	// Schema elements: type, repetition, name and converted type, after the root
+	schema := meta.list(2)
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("got %d schema elements, want %d", len(schema), len(columns)+1)
+	}
+	if root := schema[0].(thriftStructValue); root.i64(5) != int64(len(columns)) {
+		t.Errorf("root has %d children, want %d", root.i64(5), len(columns))
+	}
+	physical := make([]int64, len(columns))
+	optional := make([]bool, len(columns))
+	for i, c := range columns {
+		el := schema[i+1].(thriftStructValue)
+		if el.str(4) != c.Name {
+			t.Errorf("column %d is %s, want %s", i, el.str(4), c.Name)
+		}
+		physical[i] = el.i64(1)
+		optional[i] = el.i64(3) == 1
+		switch c.Kind {
+		case ParquetString:
+			if physical[i] != 6 || optional[i] || el.i64(6) != 0 {
+				t.Errorf("%s is %v, want a required UTF8 byte array", c.Name, el)
+			}
+		case ParquetTimestamp:
+			if physical[i] != 2 || !optional[i] || el.i64(6) != 9 {
+				t.Errorf("%s is %v, want an optional TIMESTAMP_MILLIS int64", c.Name, el)
+			}
+		}
+	}
+
+	rowGroups := meta.list(4)
+	if len(rowGroups) != 2 {
+		t.Fatalf("got %d row groups, want 2", len(rowGroups))
+	}
+	got := 0
+	for _, rgv := range rowGroups {
+		rg := rgv.(thriftStructValue)
+		chunks := rg.list(1)
+		if len(chunks) != len(columns) {
+			t.Fatalf("got %d column chunks, want %d", len(chunks), len(columns))
+		}
+		var values [][]interface{}
+		for i, cv := range chunks {
+			chunk := cv.(thriftStructValue)
+			if path := chunk.child(3).list(3); len(path) != 1 || path[0] != columns[i].Name {
+				t.Errorf("chunk %d has path %v, want %s", i, path, columns[i].Name)
+			}
+			if chunk.child(3).i64(4) != 0 {
+				t.Errorf("chunk %d has codec %d, want uncompressed", i, chunk.child(3).i64(4))
+			}
+			vs, err := readParquetColumn(file, chunk, physical[i], optional[i])
+			if err != nil {
+				t.Fatalf("chunk %d: %s", i, err)
+			}
+			if int64(len(vs)) != rg.i64(3) {
+				t.Fatalf("chunk %d has %d values, want %d", i, len(vs), rg.i64(3))
+			}
+			values = append(values, vs)
+		}
+		for r := 0; r < int(rg.i64(3)); r++ {
+			for i := range columns {
+				checkParquetValue(t, got, i, values[i][r], want[got][i])
+			}
+			got++
+		}
+	}
+	if got != numRows {
+		t.Errorf("read %d rows, want %d", got, numRows)
+	}
+}
+
+func checkParquetValue(t *testing.T, row, col int, v, want interface{}) {
+	t.Helper()
+	switch w := want.(type) {
+	case string:
+		if v != w {
+			t.Fatalf("row %d column %d is %#v, want %q", row, col, v, w)
+		}
+	case *time.Time:
+		if w == nil {
+			if v != nil {
+				t.Fatalf("row %d column %d is %#v, want null", row, col, v)
+			}
+			return
+		}
+		ms, ok := v.(int64)
+		if !ok || !time.UnixMilli(ms).Equal(w.Truncate(time.Millisecond)) {
+			t.Fatalf("row %d column %d is %#v, want %s", row, col, v, w.Truncate(time.Millisecond))
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
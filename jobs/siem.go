@@ -0,0 +1,253 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SIEM destination kinds, as stored in siem_destinations.kind
+const (
+	SIEMSyslogCEF = "syslog_cef"
+	SIEMSplunkHEC = "splunk_hec"
+)
+
+var (
+	// DefaultCEFFields maps CEF extension keys to SIEM fields, used if a destination has no fields of its own.
+	// Values starting with "=" are literals.
+	DefaultCEFFields = map[string]string{
+		"rt":       "created",
+		"dhost":    "domain",
+		"request":  "url",
+		"msg":      "reason",
+		"start":    "not_before",
+		"end":      "not_after",
+		"cs1Label": "=issuer",
+		"cs1":      "issuer",
+		"cs2Label": "=domains",
+		"cs2":      "domains",
+		"cs3Label": "=owners",
+		"cs3":      "owners",
+		"cs4Label": "=key",
+		"cs4":      "key",
+		"cs5Label": "=jurisdiction",
+		"cs5":      "jurisdiction",
+		"cs6Label": "=event_id",
+		"cs6":      "id",
+	}
+
+	cefSeverities = map[string]int{
+		EventNewCert:  3,
+		EventExpiring: 5,
+		EventLapsed:   6,
+	}
+)
+
+// SIEMExporter sends a batch of events to a SIEM
+type SIEMExporter interface {
+	Export(events []*Event) error
+}
+
+// siemFields flattens an event into the fields that can be mapped to SIEM output. See the README for the list.
+func siemFields(ev *Event, baseURL string) map[string]interface{} {
+	rv := map[string]interface{}{
+		"id":       ev.ID,
+		"type":     ev.Type,
+		"title":    eventTitle(ev),
+		"created":  ev.Created,
+		"severity": ev.Severity,
+		"reason":   ev.Reason,
+	}
+	if c := ev.Cert; c != nil {
+		rv["key"] = c.Key
+		rv["url"] = certURL(baseURL, c)
+		rv["domains"] = c.Domains
+		if len(c.Domains) != 0 {
+			rv["domain"] = c.Domains[0]
+		}
+		rv["issuer"] = c.Issuer
+		rv["jurisdiction"] = c.Jurisdiction
+		rv["cdn"] = c.CDN
+		rv["not_before"] = c.NotBefore
+		rv["not_after"] = c.NotAfter
+		rv["precert"] = c.Precert
+		rv["log"] = c.Log
+		rv["owners"] = c.Owners
+		rv["new_domains"] = c.NewDomains
+		rv["new_issuer"] = c.NewIssuer
+	}
+	return rv
+}
+
+// mapSIEMFields renames fields per the mapping of output name to field name (or "=literal").
+// A nil mapping passes all fields through.
+func mapSIEMFields(mapping map[string]string, fields map[string]interface{}) map[string]interface{} {
+	if mapping == nil {
+		return fields
+	}
+	rv := make(map[string]interface{})
+	for out, in := range mapping {
+		if strings.HasPrefix(in, "=") {
+			rv[out] = in[1:]
+		} else if v, ok := fields[in]; ok {
+			rv[out] = v
+		}
+	}
+	return rv
+}
+
+// NewSIEMExporter creates an exporter for a destination from its kind, JSON config and JSON field mapping
+// (which may be empty for the default). baseURL is the certmetrics server to link to.
+func NewSIEMExporter(kind string, config, fields []byte, baseURL string) (SIEMExporter, error) {
+	var mapping map[string]string
+	if len(fields) != 0 {
+		err := json.Unmarshal(fields, &mapping)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var e SIEMExporter
+	switch kind {
+	case SIEMSyslogCEF:
+		if mapping == nil {
+			mapping = DefaultCEFFields
+		}
+		e = &SyslogCEFExporter{BaseURL: baseURL, Fields: mapping}
+	case SIEMSplunkHEC:
+		e = &SplunkHECExporter{BaseURL: baseURL, Fields: mapping}
+	default:
+		return nil, fmt.Errorf("unknown SIEM destination kind: %s", kind)
+	}
+
+	err := json.Unmarshal(config, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// SyslogCEFExporter sends each event as a CEF message over syslog, one connection per batch.
+// Config: {"network": "tcp", "address": "siem.example.gov.au:514"}
+type SyslogCEFExporter struct {
+	BaseURL string            `json:"-"`
+	Fields  map[string]string `json:"-"`
+	Network string            `json:"network"`
+	Address string            `json:"address"`
+}
+
+func cefEscapeHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(s)
+}
+
+func cefEscapeExtension(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+func cefValue(v interface{}) string {
+	switch vv := v.(type) {
+	case time.Time:
+		// CEF timestamps are milliseconds since the epoch
+		return fmt.Sprint(vv.UnixNano() / int64(time.Millisecond))
+	case []string:
+		return strings.Join(vv, ",")
+	default:
+		return fmt.Sprint(vv)
+	}
+}
+
+// cefMessage formats the event as CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+func (sc *SyslogCEFExporter) cefMessage(ev *Event) string {
+	severity, ok := cefSeverities[ev.Type]
+	if ev.Severity == SeverityHigh || !ok {
+		severity = 8
+	}
+
+	fields := mapSIEMFields(sc.Fields, siemFields(ev, sc.BaseURL))
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ext []string
+	for _, k := range keys {
+		v := cefValue(fields[k])
+		if v == "" {
+			continue
+		}
+		ext = append(ext, k+"="+cefEscapeExtension(v))
+	}
+
+	return fmt.Sprintf("CEF:0|govau|certwatch|1.0|%s|%s|%d|%s", cefEscapeHeader(ev.Type), cefEscapeHeader(eventTitle(ev)), severity, strings.Join(ext, " "))
+}
+
+func (sc *SyslogCEFExporter) Export(events []*Event) error {
+	w, err := syslog.Dial(sc.Network, sc.Address, syslog.LOG_INFO|syslog.LOG_LOCAL0, "certwatch")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	for _, ev := range events {
+		err = w.Info(sc.cefMessage(ev))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SplunkHECExporter sends events to a Splunk HTTP Event Collector, all in one request per batch.
+// Config: {"url": "https://splunk.example.gov.au:8088", "token": "xxx", "index": "security", "sourcetype": "certwatch"}
+type SplunkHECExporter struct {
+	BaseURL    string            `json:"-"`
+	Fields     map[string]string `json:"-"`
+	URL        string            `json:"url"`
+	Token      string            `json:"token"`
+	Index      string            `json:"index"`
+	SourceType string            `json:"sourcetype"`
+}
+
+type splunkHECEvent struct {
+	Time       float64                `json:"time"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      map[string]interface{} `json:"event"`
+}
+
+func (sh *SplunkHECExporter) Export(events []*Event) error {
+	sourceType := sh.SourceType
+	if sourceType == "" {
+		sourceType = "certwatch"
+	}
+
+	// HEC takes concatenated JSON objects, rather than an array
+	var body bytes.Buffer
+	for _, ev := range events {
+		bb, err := json.Marshal(&splunkHECEvent{
+			Time:       float64(ev.Created.UnixNano()) / float64(time.Second),
+			Source:     "certwatch",
+			SourceType: sourceType,
+			Index:      sh.Index,
+			Event:      mapSIEMFields(sh.Fields, siemFields(ev, sh.BaseURL)),
+		})
+		if err != nil {
+			return err
+		}
+		body.Write(bb)
+		body.WriteString("\n")
+	}
+
+	_, err := postBody(strings.TrimSuffix(sh.URL, "/")+"/services/collector/event", body.Bytes(), map[string]string{
+		"Authorization": "Splunk " + sh.Token,
+	})
+	return err
+}
@@ -0,0 +1,367 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream kinds
+const (
+	// StreamKafka publishes to Kafka via the Confluent REST Proxy API (also served by Redpanda)
+	StreamKafka = "kafka"
+
+	// StreamNATS publishes to NATS JetStream, so the subjects must be captured by a stream
+	StreamNATS = "nats"
+)
+
+// streamMessage is an event ready to publish
+type streamMessage struct {
+	// Topic is the Kafka topic or NATS subject
+	Topic string
+
+	// Key is used for Kafka partitioning, so that events for a cert stay in order
+	Key string
+
+	// ID is the event ID, which consumers can use to deduplicate
+	ID string
+
+	Value json.RawMessage
+}
+
+// StreamPublisher publishes messages, in order, returning once the broker has accepted all of them.
+// If the broker rejects a message, rather than being unavailable, the error is a *StreamRejectedError.
+type StreamPublisher interface {
+	Publish(msgs []*streamMessage) error
+}
+
+// StreamRejectedError is returned when the broker rejects the messages, so sending the same ones again
+// won't help
+type StreamRejectedError struct {
+	Err error
+}
+
+func (e *StreamRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// NewStreamPublisher returns a publisher of the given kind
+func NewStreamPublisher(kind, u, username, password string) (StreamPublisher, error) {
+	switch kind {
+	case StreamKafka:
+		return &KafkaRESTPublisher{URL: u, Username: username, Password: password}, nil
+	case StreamNATS:
+		return &NATSPublisher{URL: u, Username: username, Password: password}, nil
+	default:
+		return nil, fmt.Errorf("unknown stream kind: %s", kind)
+	}
+}
+
+// KafkaRESTPublisher posts records to a Kafka REST Proxy, e.g. https://kafka-rest.example.gov.au:8082
+type KafkaRESTPublisher struct {
+	URL      string
+	Username string
+	Password string
+}
+
+func (kp *KafkaRESTPublisher) Publish(msgs []*streamMessage) error {
+	// Records for each topic are sent together, keeping their order
+	var topics []string
+	byTopic := make(map[string][]*streamMessage)
+	for _, m := range msgs {
+		if _, ok := byTopic[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		byTopic[m.Topic] = append(byTopic[m.Topic], m)
+	}
+
+	for _, topic := range topics {
+		type record struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		var body struct {
+			Records []*record `json:"records"`
+		}
+		for _, m := range byTopic[topic] {
+			body.Records = append(body.Records, &record{Key: m.Key, Value: m.Value})
+		}
+		bb, err := json.Marshal(&body)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(kp.URL, "/")+"/topics/"+url.PathEscape(topic), bytes.NewReader(bb))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+		req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+		if kp.Username != "" {
+			req.SetBasicAuth(kp.Username, kp.Password)
+		}
+
+		resp, err := HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			err = &HTTPStatusError{Host: req.URL.Host, StatusCode: resp.StatusCode, Body: string(data)}
+			if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+				// e.g. a record that is too large
+				return &StreamRejectedError{Err: err}
+			}
+			return err
+		}
+
+		// Each record has its own result
+		var result struct {
+			Offsets []struct {
+				ErrorCode *int   `json:"error_code"`
+				Error     string `json:"error"`
+			} `json:"offsets"`
+		}
+		err = json.Unmarshal(data, &result)
+		if err != nil {
+			return err
+		}
+		for _, o := range result.Offsets {
+			if o.ErrorCode != nil {
+				return &StreamRejectedError{Err: fmt.Errorf("kafka rejected record for %s: %v: %s", topic, *o.ErrorCode, o.Error)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// NATSPublisher publishes to NATS JetStream using the client protocol, e.g. nats://nats.example.gov.au:4222,
+// or tls:// to require TLS. Each message has a Nats-Msg-Id header, so JetStream can deduplicate, and a
+// batch is only published once the stream has acknowledged every message.
+type NATSPublisher struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// natsTimeout limits how long we wait for the server at each step
+const natsTimeout = time.Second * 30
+
+// natsPubAck is JetStream's reply to a published message
+type natsPubAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func (np *NATSPublisher) Publish(msgs []*streamMessage) error {
+	u, err := url.Parse(np.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	r := bufio.NewReader(conn)
+
+	// The server says hello first, in plain text, even if it requires TLS
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting from NATS server: %s", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+	}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if err != nil {
+		return fmt.Errorf("bad INFO from NATS server: %s", err)
+	}
+	if u.Scheme == "tls" || info.TLSRequired {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		err = tc.Handshake()
+		if err != nil {
+			return err
+		}
+		conn = tc
+		r = bufio.NewReader(conn)
+	}
+	if !info.Headers {
+		return fmt.Errorf("NATS server does not support headers")
+	}
+
+	connect := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"name":          "certwatch",
+		"lang":          "go",
+		"version":       "1",
+	}
+	username, password := np.Username, np.Password
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if username != "" && password == "" {
+		connect["auth_token"] = username
+	} else if username != "" {
+		connect["user"] = username
+		connect["pass"] = password
+	}
+	bb, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+
+	// JetStream acknowledges each message to its reply subject, under an inbox of our own
+	var inbox [12]byte
+	_, err = rand.Read(inbox[:])
+	if err != nil {
+		return err
+	}
+	replyPrefix := "_INBOX." + hex.EncodeToString(inbox[:]) + "."
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CONNECT %s\r\n", bb)
+	fmt.Fprintf(&b, "SUB %s* 1\r\n", replyPrefix)
+	for i, m := range msgs {
+		headers := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s\r\n\r\n", m.ID)
+		fmt.Fprintf(&b, "HPUB %s %s%d %d %d\r\n%s%s\r\n", m.Topic, replyPrefix, i, len(headers), len(headers)+len(m.Value), headers, m.Value)
+	}
+
+	_, err = conn.Write(b.Bytes())
+	if err != nil {
+		return err
+	}
+
+	acked := make([]bool, len(msgs))
+	remaining := len(msgs)
+	for remaining > 0 {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-ERR"):
+			err = fmt.Errorf("NATS server error: %s", strings.TrimPrefix(line, "-ERR "))
+			if strings.Contains(line, "Permissions Violation") || strings.Contains(line, "Maximum Payload Violation") {
+				return &StreamRejectedError{Err: err}
+			}
+			return err
+		case line == "PING":
+			_, err = conn.Write([]byte("PONG\r\n"))
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			subject, headers, payload, err := readNATSMsg(r, line)
+			if err != nil {
+				return err
+			}
+			i, err := strconv.Atoi(strings.TrimPrefix(subject, replyPrefix))
+			if err != nil || !strings.HasPrefix(subject, replyPrefix) || i < 0 || i >= len(msgs) {
+				return fmt.Errorf("unexpected NATS message on %s", subject)
+			}
+			err = checkNATSPubAck(headers, payload)
+			if err != nil {
+				return &StreamRejectedError{Err: fmt.Errorf("JetStream did not accept %s: %s", msgs[i].Topic, err)}
+			}
+			if !acked[i] {
+				acked[i] = true
+				remaining--
+			}
+		}
+	}
+
+	return nil
+}
+
+// readNATSMsg reads the headers and payload of the MSG or HMSG with the given control line
+func readNATSMsg(r *bufio.Reader, line string) (subject string, headers, payload []byte, err error) {
+	// MSG <subject> <sid> [reply-to] <#bytes>, or HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+	fields := strings.Fields(line)
+	hmsg := fields[0] == "HMSG"
+	minFields := 4
+	if hmsg {
+		minFields = 5
+	}
+	if len(fields) < minFields || len(fields) > minFields+1 {
+		return "", nil, nil, fmt.Errorf("bad NATS message: %s", line)
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || total < 0 {
+		return "", nil, nil, fmt.Errorf("bad NATS message: %s", line)
+	}
+	headerLen := 0
+	if hmsg {
+		headerLen, err = strconv.Atoi(fields[len(fields)-2])
+		if err != nil || headerLen < 0 || headerLen > total {
+			return "", nil, nil, fmt.Errorf("bad NATS message: %s", line)
+		}
+	}
+
+	data := make([]byte, total+2)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return fields[1], data[:headerLen], data[headerLen:total], nil
+}
+
+// checkNATSPubAck returns an error unless the reply is a JetStream acknowledgement
+func checkNATSPubAck(headers, payload []byte) error {
+	// A status in the headers, e.g. 503 if no stream captures the subject
+	if len(headers) > 0 {
+		status := strings.Fields(strings.SplitN(string(headers), "\r\n", 2)[0])
+		if len(status) > 1 {
+			return fmt.Errorf("status %s", strings.Join(status[1:], " "))
+		}
+	}
+
+	var ack natsPubAck
+	err := json.Unmarshal(payload, &ack)
+	if err != nil {
+		return fmt.Errorf("bad acknowledgement %q: %s", payload, err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("%d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("bad acknowledgement %q", payload)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package jobs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// natsServer accepts one connection, and replies to each HPUB with the result of ack(index, subject)
+func natsServer(t *testing.T, ack func(i int, subject string) string) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var lines []string
+		defer func() { got <- lines }()
+
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":1048576}\r\n")
+		r := bufio.NewReader(conn)
+		i := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			lines = append(lines, line)
+			if !strings.HasPrefix(line, "HPUB ") {
+				continue
+			}
+
+			// HPUB <subject> <reply-to> <#header bytes> <#total bytes>
+			fields := strings.Fields(line)
+			total, _ := strconv.Atoi(fields[4])
+			data := make([]byte, total+2)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return
+			}
+			lines = append(lines, string(data[:total]))
+
+			reply := ack(i, fields[1])
+			fmt.Fprintf(conn, "%s", strings.Replace(reply, "REPLY", fields[2], 1))
+			i++
+		}
+	}()
+	return "nats://" + l.Addr().String(), got
+}
+
+func pubAck(seq int) string {
+	payload := fmt.Sprintf(`{"stream":"CERTS","seq":%d}`, seq)
+	return fmt.Sprintf("MSG REPLY 1 %d\r\n%s\r\n", len(payload), payload)
+}
+
+func testStreamMessages() []*streamMessage {
+	return []*streamMessage{
+		{Topic: "certwatch.new_cert", Key: "cert1", ID: "id1", Value: []byte(`{"id":"id1"}`)},
+		{Topic: "certwatch.expiring", Key: "cert2", ID: "id2", Value: []byte(`{"id":"id2"}`)},
+	}
+}
+
+func TestKafkaRESTPublisher(t *testing.T) {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	got := make(map[string][]record)
+	var result string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/topics/") {
+			t.Errorf("got %s %s, want POST /topics/<topic>", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			t.Errorf("got basic auth %s:%s", user, pass)
+		}
+		bb, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var body struct {
+			Records []record `json:"records"`
+		}
+		err = json.Unmarshal(bb, &body)
+		if err != nil {
+			t.Errorf("bad body %s: %s", bb, err)
+		}
+		topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+		got[topic] = append(got[topic], body.Records...)
+		fmt.Fprint(w, result)
+	}))
+	defer srv.Close()
+
+	kp := &KafkaRESTPublisher{URL: srv.URL + "/", Username: "user", Password: "pass"}
+	msgs := testStreamMessages()
+	msgs = append(msgs, &streamMessage{Topic: "certwatch.new_cert", Key: "cert3", ID: "id3", Value: []byte(`{"id":"id3"}`)})
+
+	result = `{"offsets": [{"partition": 0, "offset": 1}]}`
+	err := kp.Publish(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || len(got["certwatch.new_cert"]) != 2 || len(got["certwatch.expiring"]) != 1 {
+		t.Fatalf("got %v", got)
+	}
+	// Records for a topic are sent in order
+	if r := got["certwatch.new_cert"]; r[0].Key != "cert1" || r[1].Key != "cert3" || string(r[1].Value) != `{"id":"id3"}` {
+		t.Errorf("got %v", r)
+	}
+
+	result = `{"offsets": [{"error_code": 40801, "error": "Schema registry error"}]}`
+	err = kp.Publish(msgs)
+	if err == nil || !strings.Contains(err.Error(), "40801") {
+		t.Errorf("got %v, want an error for the rejected record", err)
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	u, got := natsServer(t, func(i int, subject string) string {
+		if i == 0 {
+			// Server pings are answered while waiting
+			return "PING\r\n" + pubAck(i+1)
+		}
+		return pubAck(i + 1)
+	})
+
+	np := &NATSPublisher{URL: u, Username: "user", Password: "pass"}
+	err := np.Publish(testStreamMessages())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-got
+	if len(lines) < 7 {
+		t.Fatalf("got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "CONNECT ") || !strings.Contains(lines[0], `"headers":true`) || !strings.Contains(lines[0], `"no_responders":true`) || !strings.Contains(lines[0], `"user":"user"`) {
+		t.Errorf("got %s", lines[0])
+	}
+	sub := strings.Fields(lines[1])
+	if len(sub) != 3 || sub[0] != "SUB" || !strings.HasPrefix(sub[1], "_INBOX.") || !strings.HasSuffix(sub[1], ".*") {
+		t.Fatalf("got %s, want SUB _INBOX.<id>.* <sid>", lines[1])
+	}
+	inbox := strings.TrimSuffix(sub[1], "*")
+	for i, m := range testStreamMessages() {
+		hpub := strings.Fields(lines[2+i*2])
+		if hpub[0] != "HPUB" || hpub[1] != m.Topic || hpub[2] != inbox+strconv.Itoa(i) {
+			t.Errorf("got %s", lines[2+i*2])
+		}
+		want := "NATS/1.0\r\nNats-Msg-Id: " + m.ID + "\r\n\r\n" + string(m.Value)
+		if lines[3+i*2] != want {
+			t.Errorf("got %q, want %q", lines[3+i*2], want)
+		}
+	}
+	if lines[6] != "PONG" {
+		t.Errorf("got %s, want PONG", lines[6])
+	}
+}
+
+func TestNATSPublisherErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		reply    string
+		want     string
+		rejected bool
+	}{
+		{
+			name:     "no stream",
+			reply:    "HMSG REPLY 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\n",
+			want:     "status 503",
+			rejected: true,
+		},
+		{
+			name:     "stream error",
+			reply:    "MSG REPLY 1 72\r\n{\"error\":{\"code\":503,\"err_code\":10077,\"description\":\"maximum messages\"}}\r\n",
+			want:     "503: maximum messages",
+			rejected: true,
+		},
+		{
+			name:     "server error",
+			reply:    "-ERR 'Permissions Violation for Publish to certwatch.expiring'\r\n",
+			want:     "Permissions Violation",
+			rejected: true,
+		},
+		{
+			name:  "unavailable",
+			reply: "-ERR 'Stale Connection'\r\n",
+			want:  "Stale Connection",
+		},
+	} {
+		u, _ := natsServer(t, func(i int, subject string) string {
+			if i == 0 {
+				return pubAck(1)
+			}
+			return tc.reply
+		})
+
+		err := (&NATSPublisher{URL: u}).Publish(testStreamMessages())
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+		if _, ok := err.(*StreamRejectedError); ok != tc.rejected {
+			t.Errorf("%s: got %#v, want rejected %v", tc.name, err, tc.rejected)
+		}
+	}
+}
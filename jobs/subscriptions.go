@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// Subscription match types, as stored in notification_subscriptions.match_type
+const (
+	// MatchAll matches every cert, and ignores the pattern
+	MatchAll = "all"
+
+	// MatchDomainSuffix matches if any domain is the pattern, or a subdomain of it
+	MatchDomainSuffix = "domain_suffix"
+
+	// MatchOwner matches if any domain is owned by the pattern, per domain_owners
+	MatchOwner = "owner"
+
+	// MatchIssuer matches the issuer common name exactly (case-insensitive)
+	MatchIssuer = "issuer"
+
+	// MatchJurisdiction matches the jurisdiction, e.g. VIC, exactly (case-insensitive)
+	MatchJurisdiction = "jurisdiction"
+
+	// MatchSeverity matches findings of the given severity, e.g. high, whatever the cert
+	MatchSeverity = "severity"
+)
+
+// isSubdomainOrEqual returns true if domain is suffix, or a subdomain of it (including wildcards).
+func isSubdomainOrEqual(domain, suffix string) bool {
+	domain = strings.ToLower(domain)
+	suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+// subscriptionMatches returns true if a subscription with the given match type and pattern wants to hear about the event
+func subscriptionMatches(matchType, pattern string, ev *Event) bool {
+	c := ev.Cert
+	switch matchType {
+	case MatchAll:
+		return true
+	case MatchSeverity:
+		return ev.Severity != "" && strings.EqualFold(ev.Severity, pattern)
+	case MatchDomainSuffix:
+		for _, d := range c.Domains {
+			if isSubdomainOrEqual(d, pattern) {
+				return true
+			}
+		}
+	case MatchOwner:
+		for _, o := range c.Owners {
+			if strings.EqualFold(o, pattern) {
+				return true
+			}
+		}
+	case MatchIssuer:
+		return strings.EqualFold(c.Issuer, pattern)
+	case MatchJurisdiction:
+		return strings.EqualFold(c.Jurisdiction, pattern)
+	}
+	return false
+}
+
+// matchingChannels returns the IDs of enabled channels with at least one subscription matching the event
+func matchingChannels(tx *pgx.Tx, ev *Event) ([]int64, error) {
+	rows, err := tx.Query(`
+		SELECT s.channel_id, s.match_type, s.pattern
+		FROM notification_subscriptions s
+		JOIN notification_channels c ON c.id = s.channel_id
+		WHERE c.enabled = TRUE
+		ORDER BY s.channel_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rv []int64
+	for rows.Next() {
+		var id int64
+		var matchType, pattern string
+		err = rows.Scan(&id, &matchType, &pattern)
+		if err != nil {
+			return nil, err
+		}
+		// Ordered by channel, so only need to check the last one to avoid dupes
+		if len(rv) != 0 && rv[len(rv)-1] == id {
+			continue
+		}
+		if subscriptionMatches(matchType, pattern, ev) {
+			rv = append(rv, id)
+		}
+	}
+	return rv, rows.Err()
+}
+
+// lookupOwners returns the distinct owners of the domains, using the longest matching suffix in domain_owners for each.
+// Suffixes are compared with right() rather than LIKE, so that a _ in one is not a wildcard.
+func lookupOwners(tx *pgx.Tx, domains []string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT owner FROM (
+			SELECT DISTINCT ON (d) o.owner
+			FROM unnest($1::text[]) d
+			JOIN domain_owners o ON lower(d) = o.suffix OR right(lower(d), length(o.suffix) + 1) = '.' || o.suffix
+			ORDER BY d, length(o.suffix) DESC
+		) owners
+		ORDER BY owner`, domains)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rv []string
+	for rows.Next() {
+		var owner string
+		err = rows.Scan(&owner)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, owner)
+	}
+	return rv, rows.Err()
+}
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/jackc/pgx"
+)
+
+// Values for notification_suppressions.renewal
+const (
+	// SuppressAny matches whether or not the cert has domains new to us
+	SuppressAny = "any"
+
+	// SuppressRenewal only matches certs where every domain has been seen before
+	SuppressRenewal = "renewal"
+
+	// SuppressNewDomain only matches certs with at least one domain new to us
+	SuppressNewDomain = "new_domain"
+)
+
+// domainPatternMatches returns true if the domain matches the pattern. A pattern of the form
+// "*.example.gov.au" matches any subdomain (at any depth) of example.gov.au, otherwise it must
+// be equal. An empty pattern matches anything.
+func domainPatternMatches(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	domain = strings.ToLower(domain)
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(domain, pattern[1:])
+	default:
+		return domain == pattern
+	}
+}
+
+// suppressionMatches returns true if the rule applies to the cert. All of the cert's domains must
+// match the domain pattern, so that a cert that also covers other domains is still notified.
+func suppressionMatches(domainPattern, issuer, renewal string, c *CertInfo) bool {
+	for _, d := range c.Domains {
+		if !domainPatternMatches(domainPattern, d) {
+			return false
+		}
+	}
+	if issuer != "" && !strings.EqualFold(issuer, c.Issuer) {
+		return false
+	}
+	switch renewal {
+	case SuppressRenewal:
+		return len(c.NewDomains) == 0
+	case SuppressNewDomain:
+		return len(c.NewDomains) != 0
+	default:
+		return true
+	}
+}
+
+// isSuppressed checks the cert against the unexpired suppression rules, and records a hit against
+// each that matches. Hits are recorded in their own table rather than as a counter, so that
+// concurrent jobs don't wait on each other.
+func isSuppressed(tx *pgx.Tx, c *CertInfo) (bool, error) {
+	rows, err := tx.Query(`
+		SELECT id, domain_pattern, issuer, renewal
+		FROM notification_suppressions
+		WHERE expires IS NULL OR expires > now()`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var matched []int64
+	for rows.Next() {
+		var id int64
+		var domainPattern, issuer, renewal string
+		err = rows.Scan(&id, &domainPattern, &issuer, &renewal)
+		if err != nil {
+			return false, err
+		}
+		if suppressionMatches(domainPattern, issuer, renewal, c) {
+			matched = append(matched, id)
+		}
+	}
+	rows.Close()
+
+	if len(matched) == 0 {
+		return false, nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(c.Key)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("INSERT INTO notification_suppression_hits (suppression_id, key) SELECT unnest($1::bigint[]), $2", matched, key)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
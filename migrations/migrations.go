@@ -0,0 +1,102 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/jackc/pgx"
+)
+
+// Migration is a single numbered schema change. Migrations are only ever applied
+// upwards, and once released must not be edited - add a new one instead.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+const (
+	// AdvisoryLockID is the key for the Postgres advisory lock held while migrating,
+	// so that concurrent instances starting at the same time wait on each other
+	// rather than racing to apply the same change.
+	AdvisoryLockID = 0x63657274 // "cert"
+)
+
+// Run applies any migrations newer than the version recorded in schema_version.
+// Each migration runs in its own transaction together with the bump of schema_version.
+func Run(config *pgx.ConnConfig, logger *log.Logger) error {
+	conn, err := pgx.Connect(*config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec("SELECT pg_advisory_lock($1)", AdvisoryLockID)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec("SELECT pg_advisory_unlock($1)", AdvisoryLockID)
+
+	_, err = conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version      integer       PRIMARY KEY,
+			name         text          NOT NULL,
+			applied      timestamptz   NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	applied := 0
+	for _, m := range All {
+		if m.Version <= current {
+			continue
+		}
+
+		err = apply(conn, m)
+		if err != nil {
+			return err
+		}
+		logger.Printf("Applied migration %d (%s)", m.Version, m.Name)
+		applied++
+	}
+
+	logger.Printf("Schema is at version %d (%d migrations applied)", Latest(), applied)
+
+	return nil
+}
+
+// Latest returns the version the schema will be at once all migrations are applied.
+func Latest() int {
+	if len(All) == 0 {
+		return 0
+	}
+	return All[len(All)-1].Version
+}
+
+func apply(conn *pgx.Conn, m *Migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Pass no arguments so that the simple protocol is used, which allows multiple statements
+	_, err = tx.Exec(m.SQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version, name) VALUES ($1, $2)", m.Version, m.Name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
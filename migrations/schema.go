@@ -0,0 +1,519 @@
+package migrations
+
+// All is the ordered list of schema migrations. Versions must be strictly increasing.
+var All = []*Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		// Matches the schema previously created by InitSQL, so existing databases pick this up as a no-op.
+		SQL: `
+			CREATE TABLE IF NOT EXISTS monitored_logs (
+				url       text      PRIMARY KEY,
+				processed bigint    NOT NULL DEFAULT 0,
+				state     integer   NOT NULL DEFAULT 0,
+				connect_url text
+			);
+
+			CREATE TABLE IF NOT EXISTS cert_store (
+				key              bytea                     PRIMARY KEY,
+				leaf             bytea                     NOT NULL,
+				not_valid_before timestamp with time zone,
+				not_valid_after  timestamp with time zone,
+				issuer_cn        text,
+				jurisdiction     text,
+				cdn              text,
+				needs_update     boolean,
+				discovered       timestamptz               NOT NULL DEFAULT now()
+			);
+
+			CREATE TABLE IF NOT EXISTS cert_index (
+				key          bytea         NOT NULL,
+				domain       text          NOT NULL,
+
+				CONSTRAINT cert_index_pkey PRIMARY KEY (key, domain)
+			);
+
+			CREATE TABLE IF NOT EXISTS error_log (
+				discovered   timestamptz   NOT NULL DEFAULT now(),
+				error        text          NOT NULL
+			);
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "cert_store_needs_ckan_backfill",
+		SQL: `
+			ALTER TABLE cert_store ADD COLUMN IF NOT EXISTS needs_ckan_backfill boolean;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "cert_store_needs_update_idx",
+		// Lets the metadata refresh jobs find flagged rows in a key range without scanning the table
+		SQL: `
+			CREATE INDEX IF NOT EXISTS cert_store_needs_update_idx ON cert_store (key) WHERE needs_update = TRUE;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "cert_names",
+		// All names on each cert, not just those we watch for. Existing certs are flagged
+		// so that the metadata refresh run at startup fills them in.
+		SQL: `
+			CREATE TABLE IF NOT EXISTS cert_names (
+				key          bytea         NOT NULL,
+				name_type    text          NOT NULL,
+				name         text          NOT NULL,
+				matched      boolean       NOT NULL,
+
+				CONSTRAINT cert_names_pkey PRIMARY KEY (key, name_type, name)
+			);
+
+			CREATE INDEX IF NOT EXISTS cert_names_name_idx ON cert_names (name);
+
+			UPDATE cert_store SET needs_update = TRUE WHERE key NOT IN (SELECT key FROM cert_names);
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "notification_channels",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS notification_channels (
+				id           serial        PRIMARY KEY,
+				name         text          NOT NULL UNIQUE,
+				kind         text          NOT NULL,
+				config       jsonb         NOT NULL DEFAULT '{}',
+				enabled      boolean       NOT NULL DEFAULT TRUE
+			);
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "notification_subscriptions",
+		// Existing channels are subscribed to everything, as they were before routing was added.
+		SQL: `
+			CREATE TABLE IF NOT EXISTS domain_owners (
+				suffix       text          PRIMARY KEY,
+				owner        text          NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS notification_subscriptions (
+				id           serial        PRIMARY KEY,
+				channel_id   integer       NOT NULL REFERENCES notification_channels (id) ON DELETE CASCADE,
+				match_type   text          NOT NULL,
+				pattern      text          NOT NULL DEFAULT ''
+			);
+
+			INSERT INTO notification_subscriptions (channel_id, match_type) SELECT id, 'all' FROM notification_channels;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "notification_digests",
+		SQL: `
+			ALTER TABLE notification_channels
+				ADD COLUMN IF NOT EXISTS digest_window interval,
+				ADD COLUMN IF NOT EXISTS rate_limit    integer,
+				ADD COLUMN IF NOT EXISTS burst_started timestamptz,
+				ADD COLUMN IF NOT EXISTS burst_count   integer NOT NULL DEFAULT 0;
+
+			CREATE TABLE IF NOT EXISTS notification_digest_items (
+				id           bigserial     PRIMARY KEY,
+				channel_id   integer       NOT NULL REFERENCES notification_channels (id) ON DELETE CASCADE,
+				event        jsonb         NOT NULL,
+				created      timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS notification_digest_items_channel_idx ON notification_digest_items (channel_id, created);
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "expected_issuers",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS expected_issuers (
+				suffix       text          NOT NULL,
+				issuer       text          NOT NULL,
+
+				CONSTRAINT expected_issuers_pkey PRIMARY KEY (suffix, issuer)
+			);
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "domain_and_issuer_indexes",
+		// Used to tell whether a domain or issuer is new to us when notifying
+		SQL: `
+			CREATE INDEX IF NOT EXISTS cert_index_domain_idx ON cert_index (domain);
+			CREATE INDEX IF NOT EXISTS cert_store_issuer_cn_idx ON cert_store (issuer_cn);
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "expiry_notifications",
+		// threshold is in days, 0 meaning lapsed
+		SQL: `
+			CREATE TABLE IF NOT EXISTS expiry_notifications (
+				domain          text          NOT NULL,
+				threshold       integer       NOT NULL,
+				not_valid_after timestamptz   NOT NULL,
+				notified        timestamptz   NOT NULL DEFAULT now(),
+
+				CONSTRAINT expiry_notifications_pkey PRIMARY KEY (domain, threshold, not_valid_after)
+			);
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "notification_suppressions",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS notification_suppressions (
+				id             serial        PRIMARY KEY,
+				description    text          NOT NULL DEFAULT '',
+				domain_pattern text          NOT NULL DEFAULT '',
+				issuer         text          NOT NULL DEFAULT '',
+				renewal        text          NOT NULL DEFAULT 'any',
+				expires        timestamptz,
+				created        timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE TABLE IF NOT EXISTS notification_suppression_hits (
+				suppression_id integer       NOT NULL REFERENCES notification_suppressions (id) ON DELETE CASCADE,
+				key            bytea         NOT NULL,
+				created        timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS notification_suppression_hits_suppression_id_idx ON notification_suppression_hits (suppression_id);
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "cert_triage",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS cert_triage (
+				id         bigserial     PRIMARY KEY,
+				key        bytea         NOT NULL,
+				response   text          NOT NULL,
+				user_id    text          NOT NULL,
+				user_name  text          NOT NULL DEFAULT '',
+				channel    text          NOT NULL DEFAULT '',
+				created    timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS cert_triage_key_idx ON cert_triage (key);
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "pager_incidents",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS pager_incidents (
+				event_id   text          NOT NULL,
+				channel_id integer       NOT NULL REFERENCES notification_channels (id) ON DELETE CASCADE,
+				key        bytea,
+				event_type text          NOT NULL,
+				status     text          NOT NULL,
+				created    timestamptz   NOT NULL DEFAULT now(),
+				updated    timestamptz   NOT NULL DEFAULT now(),
+
+				PRIMARY KEY (event_id, channel_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS pager_incidents_key_idx ON pager_incidents (key) WHERE status != 'resolved';
+		`,
+	},
+	{
+		Version: 14,
+		Name:    "siem_export",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS siem_destinations (
+				id      serial   PRIMARY KEY,
+				name    text     NOT NULL UNIQUE,
+				kind    text     NOT NULL,
+				config  jsonb    NOT NULL DEFAULT '{}',
+				fields  jsonb,
+				enabled boolean  NOT NULL DEFAULT TRUE
+			);
+
+			CREATE TABLE IF NOT EXISTS siem_events (
+				id             bigserial     PRIMARY KEY,
+				destination_id integer       NOT NULL REFERENCES siem_destinations (id) ON DELETE CASCADE,
+				event          jsonb         NOT NULL,
+				attempts       integer       NOT NULL DEFAULT 0,
+				next_attempt   timestamptz   NOT NULL DEFAULT now(),
+				last_error     text,
+				created        timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS siem_events_destination_id_idx ON siem_events (destination_id, next_attempt);
+		`,
+	},
+	{
+		Version: 15,
+		Name:    "notification_deliveries",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS notification_deliveries (
+				id            bigserial     PRIMARY KEY,
+				channel_id    integer       NOT NULL REFERENCES notification_channels (id) ON DELETE CASCADE,
+				event_id      text          NOT NULL,
+				event_type    text          NOT NULL,
+				key           bytea,
+				payload       jsonb         NOT NULL,
+				status        text          NOT NULL,
+				attempts      integer       NOT NULL DEFAULT 0,
+				response_code integer,
+				last_error    text,
+				created       timestamptz   NOT NULL DEFAULT now(),
+				updated       timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS notification_deliveries_channel_id_idx ON notification_deliveries (channel_id, status);
+			CREATE INDEX IF NOT EXISTS notification_deliveries_key_idx ON notification_deliveries (key);
+		`,
+	},
+	{
+		Version: 16,
+		Name:    "ckan_resources",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS ckan_resources (
+				base_url    text          NOT NULL,
+				package_id  text          NOT NULL,
+				resource_id text          NOT NULL,
+				created     timestamptz   NOT NULL DEFAULT now(),
+
+				PRIMARY KEY (base_url, package_id)
+			);
+		`,
+	},
+	{
+		Version: 17,
+		Name:    "ckan_outbox",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS ckan_outbox (
+				key        bytea         PRIMARY KEY REFERENCES cert_store (key) ON DELETE CASCADE,
+				attempts   integer       NOT NULL DEFAULT 0,
+				failed     boolean       NOT NULL DEFAULT FALSE,
+				last_error text,
+				created    timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS ckan_outbox_created_idx ON ckan_outbox (created) WHERE NOT failed;
+		`,
+	},
+	{
+		Version: 18,
+		Name:    "ckan_reconcile",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS ckan_reconcile_runs (
+				id          serial        PRIMARY KEY,
+				resource_id text          NOT NULL,
+				started     timestamptz   NOT NULL DEFAULT now(),
+				finished    timestamptz,
+				fetched     bigint        NOT NULL DEFAULT 0,
+				local       bigint,
+				missing     bigint,
+				extra       bigint
+			);
+
+			CREATE TABLE IF NOT EXISTS ckan_reconcile_keys (
+				run_id integer NOT NULL REFERENCES ckan_reconcile_runs (id) ON DELETE CASCADE,
+				key    bytea   NOT NULL,
+
+				PRIMARY KEY (run_id, key)
+			);
+		`,
+	},
+	{
+		Version: 19,
+		Name:    "cert_store_open_data_fields",
+		// Existing certs are flagged so that the metadata refresh run at startup fills in the new
+		// columns, which also sends them to CKAN again. Logs are only known for certs seen from now.
+		SQL: `
+			ALTER TABLE cert_store
+				ADD COLUMN IF NOT EXISTS issuer_o           text,
+				ADD COLUMN IF NOT EXISTS entry_type         text,
+				ADD COLUMN IF NOT EXISTS fingerprint_sha256 text,
+				ADD COLUMN IF NOT EXISTS fingerprint_sha1   text,
+				ADD COLUMN IF NOT EXISTS key_type           text;
+
+			CREATE TABLE IF NOT EXISTS cert_logs (
+				key        bytea         NOT NULL,
+				log_url    text          NOT NULL,
+				first_seen timestamptz   NOT NULL DEFAULT now(),
+
+				CONSTRAINT cert_logs_pkey PRIMARY KEY (key, log_url)
+			);
+
+			UPDATE cert_store SET needs_update = TRUE WHERE entry_type IS NULL;
+		`,
+	},
+	{
+		Version: 20,
+		Name:    "dataset_exports",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS dataset_exports (
+				id           serial        PRIMARY KEY,
+				kind         text          NOT NULL,
+				period_start timestamptz,
+				period_end   timestamptz   NOT NULL,
+				rows         bigint        NOT NULL,
+				location     text          NOT NULL,
+				created      timestamptz   NOT NULL DEFAULT now(),
+
+				UNIQUE (kind, period_end)
+			);
+
+			CREATE INDEX IF NOT EXISTS cert_store_discovered_idx ON cert_store (discovered);
+		`,
+	},
+	{
+		Version: 21,
+		Name:    "opensearch_outbox",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS opensearch_outbox (
+				key        bytea         PRIMARY KEY REFERENCES cert_store (key) ON DELETE CASCADE,
+				attempts   integer       NOT NULL DEFAULT 0,
+				failed     boolean       NOT NULL DEFAULT FALSE,
+				last_error text,
+				created    timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS opensearch_outbox_created_idx ON opensearch_outbox (created) WHERE NOT failed;
+		`,
+	},
+	{
+		Version: 22,
+		Name:    "stream_outbox",
+		SQL: `
+			CREATE TABLE IF NOT EXISTS stream_outbox (
+				id           bigserial     PRIMARY KEY,
+				event_type   text          NOT NULL,
+				event        jsonb         NOT NULL,
+				attempts     integer       NOT NULL DEFAULT 0,
+				next_attempt timestamptz   NOT NULL DEFAULT now(),
+				last_error   text,
+				created      timestamptz   NOT NULL DEFAULT now()
+			);
+		`,
+	},
+	{
+		Version: 23,
+		Name:    "cert_names_reverse_name_index",
+		// Lets subdomain searches, e.g. reverse(name) LIKE 'ua.vog.elpmaxe.%', use an index
+		SQL: `
+			CREATE INDEX IF NOT EXISTS cert_names_reverse_name_idx ON cert_names (reverse(name) text_pattern_ops);
+		`,
+	},
+	{
+		Version: 24,
+		Name:    "notification_sends",
+		// Replaces burst_count, so that Notify doesn't hold a lock on the channel while sending. There
+		// is deliberately no foreign key, as that would lock the channel row too.
+		SQL: `
+			CREATE TABLE IF NOT EXISTS notification_sends (
+				id           bigserial     PRIMARY KEY,
+				channel_id   integer       NOT NULL,
+				created      timestamptz   NOT NULL DEFAULT now()
+			);
+
+			CREATE INDEX IF NOT EXISTS notification_sends_channel_id_created_idx ON notification_sends (channel_id, created);
+
+			ALTER TABLE notification_channels
+				DROP COLUMN IF EXISTS burst_started,
+				DROP COLUMN IF EXISTS burst_count;
+		`,
+	},
+	{
+		Version: 25,
+		Name:    "ckan_reconcile_last_id",
+		// Runs are paged by datastore _id rather than offset. failed counts keys CKAN is missing that the
+		// outbox has given up on.
+		SQL: `
+			ALTER TABLE ckan_reconcile_runs
+				ADD COLUMN IF NOT EXISTS last_id bigint NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS failed  bigint;
+		`,
+	},
+	{
+		Version: 26,
+		Name:    "precert_fingerprints",
+		// Precert fingerprints were of the TBSCertificate, not the precertificate. They are cleared, and
+		// filled in again from the extra data when the precert is next seen in a log. The certs are flagged
+		// so that the metadata refresh run at startup sends them to CKAN and OpenSearch without them.
+		SQL: `
+			UPDATE cert_store SET fingerprint_sha256 = NULL, fingerprint_sha1 = NULL, needs_update = TRUE WHERE entry_type = 'precert';
+		`,
+	},
+	{
+		Version: 27,
+		Name:    "domain_owners_reindex",
+		// OpenSearch documents include owners, so certs under a suffix are indexed again when its owner
+		// changes. A trigger catches changes made by hand, as in the README.
+		SQL: `
+			CREATE OR REPLACE FUNCTION domain_owners_reindex() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP IN ('UPDATE', 'DELETE') THEN
+					INSERT INTO opensearch_outbox (key)
+					SELECT DISTINCT key FROM cert_index WHERE domain = OLD.suffix OR domain LIKE '%.' || OLD.suffix
+					ON CONFLICT DO NOTHING;
+				END IF;
+				IF TG_OP IN ('INSERT', 'UPDATE') THEN
+					INSERT INTO opensearch_outbox (key)
+					SELECT DISTINCT key FROM cert_index WHERE domain = NEW.suffix OR domain LIKE '%.' || NEW.suffix
+					ON CONFLICT DO NOTHING;
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+
+			DROP TRIGGER IF EXISTS domain_owners_reindex ON domain_owners;
+			CREATE TRIGGER domain_owners_reindex AFTER INSERT OR UPDATE OR DELETE ON domain_owners
+				FOR EACH ROW EXECUTE PROCEDURE domain_owners_reindex();
+		`,
+	},
+	{
+		Version: 28,
+		Name:    "stream_outbox_failed",
+		SQL: `
+			ALTER TABLE stream_outbox ADD COLUMN IF NOT EXISTS failed boolean NOT NULL DEFAULT FALSE;
+			CREATE INDEX IF NOT EXISTS stream_outbox_id_idx ON stream_outbox (id) WHERE NOT failed;
+		`,
+	},
+	{
+		Version: 29,
+		Name:    "cert_index_reverse_domain_index",
+		// Lets subdomain lookups, e.g. reverse(domain) LIKE 'ua.vog.elpmaxe.%', use an index, including when
+		// domain owners change
+		SQL: `
+			CREATE INDEX IF NOT EXISTS cert_index_reverse_domain_idx ON cert_index (reverse(domain) text_pattern_ops);
+
+			CREATE OR REPLACE FUNCTION domain_owners_reindex() RETURNS trigger AS $$
+			BEGIN
+				IF TG_OP IN ('UPDATE', 'DELETE') THEN
+					INSERT INTO opensearch_outbox (key)
+					SELECT DISTINCT key FROM cert_index
+					WHERE domain = OLD.suffix
+					OR reverse(domain) LIKE replace(replace(replace(reverse('.' || OLD.suffix), '\', '\\'), '%', '\%'), '_', '\_') || '%'
+					ON CONFLICT DO NOTHING;
+				END IF;
+				IF TG_OP IN ('INSERT', 'UPDATE') THEN
+					INSERT INTO opensearch_outbox (key)
+					SELECT DISTINCT key FROM cert_index
+					WHERE domain = NEW.suffix
+					OR reverse(domain) LIKE replace(replace(replace(reverse('.' || NEW.suffix), '\', '\\'), '%', '\%'), '_', '\_') || '%'
+					ON CONFLICT DO NOTHING;
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;
+		`,
+	},
+	{
+		Version: 30,
+		Name:    "cert_index_domain_pattern_index",
+		// Lets prefix matches from crt.sh queries, e.g. domain LIKE 'www.example.%', use an index
+		SQL: `
+			CREATE INDEX IF NOT EXISTS cert_index_domain_pattern_idx ON cert_index (domain text_pattern_ops);
+		`,
+	},
+}